@@ -0,0 +1,129 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+const (
+	defaultCacheFile = ".protoc-go-inject-tag.cache"
+	// cacheVersion is bumped whenever the output for the same input and
+	// options may change, invalidating existing caches.
+	cacheVersion = 5
+)
+
+// cacheEntry records the result of injecting an input file.
+type cacheEntry struct {
+	Output string `json:"output"`
+	// Options is the fingerprint of the options the file was injected with.
+	Options    string `json:"options"`
+	InputHash  string `json:"input_hash"`
+	OutputHash string `json:"output_hash"`
+}
+
+// cache records the files injected by previous runs, so that those that have
+// not changed since can be skipped. Lookups are safe for concurrent use, but
+// updates are not.
+type cache struct {
+	Version int                   `json:"version"`
+	Files   map[string]cacheEntry `json:"files"`
+
+	path string
+}
+
+// loadCache reads the cache at path. A missing, unreadable or outdated cache is
+// not an error, it just starts out empty.
+func loadCache(path string) (*cache, error) {
+	c := &cache{path: path}
+	contents, err := os.ReadFile(path)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+	if err == nil {
+		if err = json.Unmarshal(contents, c); err != nil {
+			logf("warn: ignoring invalid cache %q: %v", path, err)
+		}
+	}
+	if c.Version != cacheVersion || c.Files == nil {
+		c.Version, c.Files = cacheVersion, map[string]cacheEntry{}
+	}
+	return c, nil
+}
+
+// upToDate reports whether input was injected into output with the same
+// options before, and neither of them changed since. It also returns the hash
+// of the input, to be recorded once the file is injected.
+func (c *cache) upToDate(input, output, fingerprint string) (inputHash string, ok bool, err error) {
+	inputHash, err = hashFile(input)
+	if err != nil {
+		return
+	}
+	entry, found := c.Files[filepath.Clean(input)]
+	if !found || entry.Output != filepath.Clean(output) || entry.Options != fingerprint {
+		return
+	}
+
+	// an input injected in place must look like its last output, a separate
+	// input like its last input
+	if input == output {
+		return inputHash, inputHash == entry.OutputHash, nil
+	}
+	if inputHash != entry.InputHash {
+		return
+	}
+	outputHash, err := hashFile(output)
+	if errors.Is(err, fs.ErrNotExist) {
+		return inputHash, false, nil
+	}
+	return inputHash, outputHash == entry.OutputHash, err
+}
+
+func (c *cache) record(input string, entry cacheEntry) {
+	entry.Output = filepath.Clean(entry.Output)
+	c.Files[filepath.Clean(input)] = entry
+}
+
+// prune forgets the input files that no longer exist.
+func (c *cache) prune() {
+	for input := range c.Files {
+		if _, err := os.Stat(input); errors.Is(err, fs.ErrNotExist) {
+			logf("file %q no longer exists, removing it from the cache", input)
+			delete(c.Files, input)
+		}
+	}
+}
+
+func (c *cache) save() error {
+	contents, err := json.MarshalIndent(c, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(c.path, append(contents, '\n'), 0o644)
+}
+
+// fingerprint identifies opts in the cache.
+func (opts options) fingerprint() string {
+	contents, err := json.Marshal(opts)
+	if err != nil {
+		panic(err)
+	}
+	return hashBytes(contents)
+}
+
+func hashFile(path string) (string, error) {
+	contents, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return hashBytes(contents), nil
+}
+
+func hashBytes(contents []byte) string {
+	sum := sha256.Sum256(contents)
+	return hex.EncodeToString(sum[:])
+}
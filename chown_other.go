@@ -0,0 +1,13 @@
+//go:build windows || plan9
+
+package main
+
+import (
+	"io/fs"
+	"os"
+)
+
+// chown is a no-op on platforms without POSIX file ownership.
+func chown(f *os.File, src fs.FileInfo) error {
+	return nil
+}
@@ -0,0 +1,25 @@
+//go:build !windows && !plan9
+
+package main
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"syscall"
+)
+
+// chown gives f the owner and group of src. Lacking the permission to do so is
+// not an error, the file then keeps the owner of the running process.
+func chown(f *os.File, src fs.FileInfo) error {
+	st, ok := src.Sys().(*syscall.Stat_t)
+	if !ok {
+		return nil
+	}
+	err := f.Chown(int(st.Uid), int(st.Gid))
+	if errors.Is(err, fs.ErrPermission) {
+		logf("warn: can't preserve ownership of %q: %v", src.Name(), err)
+		return nil
+	}
+	return err
+}
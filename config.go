@@ -0,0 +1,383 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+// config is the contents of a -config file. Its fields are part of options,
+// so that manifest entries can set them too, and the cache notices when they
+// change.
+type config struct {
+	// Rules inject tags into the fields they match, without a directive.
+	Rules []rule `json:"rules,omitempty" yaml:"rules,omitempty"`
+	// Macros are named tag sets that tags can refer to as @name, or
+	// @name(arguments) for those with parameters $1 to $9.
+	Macros map[string]string `json:"macros,omitempty" yaml:"macros,omitempty"`
+	// Vars are the variables that tags can refer to as ${name}.
+	Vars map[string]string `json:"vars,omitempty" yaml:"vars,omitempty"`
+	// Conflicts are the conflict policies of keys, or of all keys for "*".
+	Conflicts map[string]string `json:"conflicts,omitempty" yaml:"conflicts,omitempty"`
+}
+
+// rule injects Tags into the fields matching all of its selectors:
+//
+//   - Match is either the proto full name of a field (acme.user.v1.User.email)
+//     or its Go name (User.Email). A "*" in it matches any part of a name
+//     between dots.
+//   - Struct, Field and Type are regular expressions matching the whole Go
+//     name of the struct, of the field, and the Go type expression of the
+//     field (*timestamppb.Timestamp), respectively.
+//   - Protobuf matches the metadata in the protobuf tag of the field.
+//
+// If is an optional condition the field must satisfy, see cond.
+type rule struct {
+	Match    string         `json:"match,omitempty" yaml:"match,omitempty"`
+	Struct   string         `json:"struct,omitempty" yaml:"struct,omitempty"`
+	Field    string         `json:"field,omitempty" yaml:"field,omitempty"`
+	Type     string         `json:"type,omitempty" yaml:"type,omitempty"`
+	Protobuf *protoSelector `json:"protobuf,omitempty" yaml:"protobuf,omitempty"`
+	If       string         `json:"if,omitempty" yaml:"if,omitempty"`
+	Tags     string         `json:"tags" yaml:"tags"`
+}
+
+// loadConfig reads a YAML or, if path ends with ".toml", a TOML config file.
+func loadConfig(path string) (c config, err error) {
+	contents, err := os.ReadFile(path)
+	if err != nil {
+		return
+	}
+	if c, err = parseConfig(contents, strings.EqualFold(filepath.Ext(path), ".toml")); err != nil {
+		return c, fmt.Errorf("invalid config %q: %w", path, err)
+	}
+	return
+}
+
+// parseConfig decodes a YAML or TOML config. Both are converted to JSON first,
+// so that they share the field names and strictness of manifest options.
+func parseConfig(contents []byte, isTOML bool) (c config, err error) {
+	var raw map[string]interface{}
+	if isTOML {
+		err = toml.Unmarshal(contents, &raw)
+	} else {
+		err = yaml.Unmarshal(contents, &raw)
+	}
+	if err != nil {
+		return
+	}
+
+	encoded, err := json.Marshal(raw)
+	if err != nil {
+		return
+	}
+	dec := json.NewDecoder(bytes.NewReader(encoded))
+	dec.DisallowUnknownFields()
+	if err = dec.Decode(&c); err != nil {
+		return
+	}
+	return c, c.validate()
+}
+
+// merge returns c with overlay layered on top of it. The rules of overlay come
+// after those of c, so they take precedence, and its macros, variables and
+// conflict policies replace those of c with the same names.
+func (c config) merge(overlay config) config {
+	c.Rules = append(append([]rule{}, c.Rules...), overlay.Rules...)
+	c.Macros = mergeMaps(c.Macros, overlay.Macros)
+	c.Vars = mergeMaps(c.Vars, overlay.Vars)
+	c.Conflicts = mergeMaps(c.Conflicts, overlay.Conflicts)
+	return c
+}
+
+// mergeMaps returns the entries of m and overlay, those of overlay replacing
+// those of m with the same keys.
+func mergeMaps(m, overlay map[string]string) map[string]string {
+	if len(m) == 0 && len(overlay) == 0 {
+		return nil
+	}
+	merged := map[string]string{}
+	for _, entries := range []map[string]string{m, overlay} {
+		for key, value := range entries {
+			merged[key] = value
+		}
+	}
+	return merged
+}
+
+// configNames are the names of the config files looked up next to the input
+// files and in their parent directories, in order of preference.
+var configNames = []string{".gotags.yaml", ".gotags.yml", ".gotags.toml"}
+
+// configFinder looks up the config of input files without a -config. It is
+// safe for concurrent use.
+type configFinder struct {
+	mu   sync.Mutex
+	dirs map[string]foundConfig
+}
+
+// foundConfig is the merged config of a directory, and the config files it is
+// made of, outermost first.
+type foundConfig struct {
+	config config
+	files  []string
+	err    error
+}
+
+func newConfigFinder() *configFinder {
+	return &configFinder{dirs: map[string]foundConfig{}}
+}
+
+// find returns the config of the input file at path: the config files of its
+// directory and of every parent directory, nested ones merged over their
+// parents.
+func (f *configFinder) find(path string) (c config, files []string, err error) {
+	dir, err := filepath.Abs(filepath.Dir(path))
+	if err != nil {
+		return
+	}
+	found := f.findDir(dir)
+	return found.config, found.files, found.err
+}
+
+func (f *configFinder) findDir(dir string) foundConfig {
+	f.mu.Lock()
+	found, ok := f.dirs[dir]
+	f.mu.Unlock()
+	if ok {
+		return found
+	}
+
+	if parent := filepath.Dir(dir); parent != dir {
+		found = f.findDir(parent)
+	}
+	if found.err == nil {
+		for _, name := range configNames {
+			file := filepath.Join(dir, name)
+			if _, err := os.Stat(file); err != nil {
+				continue
+			}
+			c, err := loadConfig(file)
+			if err != nil {
+				found = foundConfig{err: err}
+				break
+			}
+			found.config = found.config.merge(c)
+			found.files = append(append([]string{}, found.files...), file)
+			break
+		}
+	}
+
+	f.mu.Lock()
+	f.dirs[dir] = found
+	f.mu.Unlock()
+	return found
+}
+
+// printConfig writes the config of the input file at path as YAML to w, after
+// a comment listing the config files it comes from.
+func printConfig(w io.Writer, path string, c config, files []string) error {
+	fmt.Fprintf(w, "# config of %s\n", path)
+	for _, file := range files {
+		fmt.Fprintf(w, "# from %s\n", file)
+	}
+	enc := yaml.NewEncoder(w)
+	enc.SetIndent(2)
+	if err := enc.Encode(c); err != nil {
+		return err
+	}
+	return enc.Close()
+}
+
+// validate checks the macros, and the selectors and tags of the rules. The
+// macros used by the rules may be defined by other config files.
+func (c config) validate() error {
+	if err := c.validateMacros(); err != nil {
+		return err
+	}
+	if err := validateVars(c.Vars); err != nil {
+		return err
+	}
+	if err := validateConflicts(c.Conflicts); err != nil {
+		return err
+	}
+	for i, r := range c.Rules {
+		if r.Match == "" && r.Struct == "" && r.Field == "" && r.Type == "" && r.Protobuf == nil && r.If == "" {
+			return fmt.Errorf("rule #%d has no selector", i+1)
+		}
+		if _, err := path.Match(selectorPath(r.Match), ""); err != nil {
+			return fmt.Errorf("rule #%d: invalid selector %q: %w", i+1, r.Match, err)
+		}
+		patterns := []string{r.Struct, r.Field, r.Type}
+		if r.Protobuf != nil {
+			patterns = append(patterns, r.Protobuf.patterns()...)
+		}
+		for _, pattern := range patterns {
+			if _, err := compileSelector(pattern); err != nil {
+				return fmt.Errorf("rule #%d: invalid selector %q: %w", i+1, pattern, err)
+			}
+		}
+		if r.If != "" {
+			if _, err := compileCond(r.If); err != nil {
+				return fmt.Errorf("rule #%d: %w", i+1, err)
+			}
+		}
+		if strings.TrimSpace(r.Tags) == "" || malformedTag(stripMacros(r.Tags)) {
+			return fmt.Errorf("rule #%d: malformed tags %q", i+1, r.Tags)
+		}
+	}
+	return nil
+}
+
+// fieldInfo describes a struct field for rules to match.
+type fieldInfo struct {
+	// Struct and Name are the Go names of the struct and the field.
+	Struct string
+	Name   string
+	// Type is the Go type expression of the field.
+	Type string
+	// Proto is the proto full name of the field, or "" if it isn't known.
+	Proto string
+	// Protobuf is the metadata in the protobuf tag of the field, or nil if it
+	// isn't a protobuf field.
+	Protobuf *protoTag
+	// Message is the proto full name of the struct, or "" if it isn't known.
+	Message string
+	// File is the path of the input file, with slashes.
+	File string
+	// Profile is the selected profile, if any.
+	Profile string
+}
+
+// protobuf returns the protobuf metadata of the field, which is empty if it
+// isn't a protobuf field.
+func (f fieldInfo) protobuf() protoTag {
+	if f.Protobuf == nil {
+		return protoTag{}
+	}
+	return *f.Protobuf
+}
+
+// proto3Optional reports whether the field is declared optional in a proto3
+// file. protoc-gen-go tags those as members of a oneof, but they are fields of
+// the message struct itself rather than of a oneof wrapper struct, which
+// isn't a message.
+func (f fieldInfo) proto3Optional() bool {
+	pt := f.protobuf()
+	return pt.Proto3 && pt.Oneof && f.Message != ""
+}
+
+// oneof reports whether the field is a oneof or one of its members, which
+// proto3 optional fields aren't, despite their tags.
+func (f fieldInfo) oneof() bool {
+	return f.protobuf().Oneof && !f.proto3Optional()
+}
+
+// protoType returns the proto type of the field, or "" if it isn't a
+// protobuf field.
+func (f fieldInfo) protoType() string {
+	if f.Protobuf == nil {
+		return ""
+	}
+	return protoType(*f.Protobuf, f.Type)
+}
+
+// match returns the tags of the rules matching field, in the order of the
+// rules.
+func (c config) match(field fieldInfo) (tags []string) {
+	for _, r := range c.Rules {
+		if r.matches(field) {
+			tags = append(tags, r.Tags)
+		}
+	}
+	return
+}
+
+func (r rule) matches(field fieldInfo) bool {
+	if r.Match != "" && !matchSelector(r.Match, field.Struct+"."+field.Name) &&
+		(field.Proto == "" || !matchSelector(r.Match, field.Proto)) {
+		return false
+	}
+	if r.Protobuf != nil && (field.Protobuf == nil || !r.Protobuf.matches(field)) {
+		return false
+	}
+	return matchRegexp(r.Struct, field.Struct) && matchRegexp(r.Field, field.Name) && matchRegexp(r.Type, field.Type) &&
+		evalCond(r.If, field)
+}
+
+// xxxSkipRule is the rule -XXX_skip stands for.
+func xxxSkipRule(skip []string) rule {
+	tags := make([]string, len(skip))
+	for i, key := range skip {
+		tags[i] = fmt.Sprintf("%s:\"-\"", key)
+	}
+	return rule{Field: "XXX.*", Tags: strings.Join(tags, " ")}
+}
+
+// matchSelector reports whether the dotted name matches selector.
+func matchSelector(selector, name string) bool {
+	ok, _ := path.Match(selectorPath(selector), selectorPath(name))
+	return ok
+}
+
+// selectors caches the compiled regular expressions of rules.
+var selectors sync.Map
+
+// compileSelector compiles a regular expression matching whole names.
+func compileSelector(pattern string) (*regexp.Regexp, error) {
+	if re, ok := selectors.Load(pattern); ok {
+		return re.(*regexp.Regexp), nil
+	}
+	re, err := regexp.Compile("^(?:" + pattern + ")$")
+	if err != nil {
+		return nil, err
+	}
+	selectors.Store(pattern, re)
+	return re, nil
+}
+
+// matchRegexp reports whether s matches the regular expression pattern, which
+// an empty pattern always does.
+func matchRegexp(pattern, s string) bool {
+	if pattern == "" {
+		return true
+	}
+	re, err := compileSelector(pattern)
+	return err == nil && re.MatchString(s)
+}
+
+// selectorPath turns the dots of a selector or name into slashes, so that
+// path.Match doesn't let a "*" match across them.
+func selectorPath(s string) string {
+	return strings.ReplaceAll(s, ".", "/")
+}
+
+// rGoType matches the comments protoc-gen-go puts after the message types of a
+// file, e.g. "(*IP)(nil), // 0: pb.IP".
+var rGoType = regexp.MustCompile(`^\s*\(\*(\w+)\)\(nil\),\s*// \d+: ([\w.]+)\s*$`)
+
+// protoMessages maps the Go names of the messages of a file generated by
+// protoc-gen-go to their proto full names.
+func protoMessages(src []byte) map[string]string {
+	messages := map[string]string{}
+	marker := []byte(")(nil),")
+	for i := bytes.Index(src, marker); i >= 0; {
+		line := src[lineStart(src, i):lineEnd(src, i)]
+		if match := rGoType.FindSubmatch(line); match != nil {
+			messages[string(match[1])] = string(match[2])
+		}
+		src = src[lineEnd(src, i):]
+		i = bytes.Index(src, marker)
+	}
+	return messages
+}
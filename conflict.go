@@ -0,0 +1,148 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Conflict policies decide what happens when a directive or rule sets a key
+// the field already has a different value for.
+const (
+	// conflictOverride replaces the existing value. It is the default.
+	conflictOverride = "override"
+	// conflictKeepExisting keeps the existing value.
+	conflictKeepExisting = "keep-existing"
+	// conflictMerge adds the comma separated options of the new value that
+	// the existing value doesn't have, e.g. validate:"required,email".
+	conflictMerge = "merge"
+	// conflictError reports an error.
+	conflictError = "error"
+)
+
+// anyKey is the key of the conflict policy applying to the keys without one.
+const anyKey = "*"
+
+// protectedKeys are the keys protoc-gen-go needs to encode the fields, whose
+// conflict policy is conflictError unless set otherwise.
+var protectedKeys = []string{"protobuf", "protobuf_oneof"}
+
+func validConflictPolicy(policy string) bool {
+	switch policy {
+	case conflictOverride, conflictKeepExisting, conflictMerge, conflictError:
+		return true
+	}
+	return false
+}
+
+// validateConflicts checks the policies of conflicts, which maps keys, or
+// anyKey, to policies.
+func validateConflicts(conflicts map[string]string) error {
+	for key, policy := range conflicts {
+		if !validConflictPolicy(policy) {
+			return fmt.Errorf("unknown conflict policy %q for key %q", policy, key)
+		}
+	}
+	return nil
+}
+
+// conflictPolicy returns the conflict policy of key. The policies set for key
+// win over those set for anyKey, and those given with -conflict over those of
+// the config.
+func (opts options) conflictPolicy(key string) string {
+	for _, k := range []string{key, anyKey} {
+		for _, conflicts := range []map[string]string{opts.FlagConflicts, opts.Conflicts} {
+			if policy, ok := conflicts[k]; ok {
+				return policy
+			}
+		}
+		if k == key {
+			for _, protected := range protectedKeys {
+				if key == protected {
+					return conflictError
+				}
+			}
+		}
+	}
+	return conflictOverride
+}
+
+// checkConflicts returns an error if tag sets a key of current, the tag of
+// field, to another value, and the policy of the key forbids it.
+func (opts options) checkConflicts(field fieldInfo, current, tag string) error {
+	existing := newTagItems(current)
+	for _, item := range newTagItems(tag) {
+		for _, e := range existing {
+			if e.key == item.key && e.value != item.value && opts.conflictPolicy(item.key) == conflictError {
+				return fmt.Errorf("can't set key %q of field %s.%s to %s, it is %s already and protected", item.key, field.Struct, field.Name, item.value, e.value)
+			}
+		}
+	}
+	return nil
+}
+
+// resolve applies the injected items nti to ti, following the conflict policy
+// of each key.
+func (ti tagItems) resolve(nti tagItems, policy func(key string) string) tagItems {
+	resolved := tagItems{}
+	for _, item := range nti {
+		switch policy(item.key) {
+		case conflictKeepExisting:
+			if ti.has(item.key) {
+				continue
+			}
+		case conflictMerge:
+			for _, e := range ti {
+				if e.key == item.key {
+					item.value = mergeValues(e.value, item.value)
+				}
+			}
+		}
+		resolved = append(resolved, item)
+	}
+	return ti.override(resolved)
+}
+
+func (ti tagItems) has(key string) bool {
+	for _, item := range ti {
+		if item.key == key {
+			return true
+		}
+	}
+	return false
+}
+
+// mergeValues adds the comma separated options of the quoted value to those
+// of the quoted existing value it doesn't have.
+func mergeValues(existing, value string) string {
+	options := strings.Split(strings.Trim(existing, `"`), ",")
+	for _, option := range strings.Split(strings.Trim(value, `"`), ",") {
+		found := false
+		for _, o := range options {
+			found = found || o == option
+		}
+		if !found {
+			options = append(options, option)
+		}
+	}
+	return `"` + strings.Join(options, ",") + `"`
+}
+
+// conflictsFlag is a repeatable -conflict flag, either a policy for all keys
+// or a key=policy pair.
+type conflictsFlag map[string]string
+
+func (c conflictsFlag) String() string {
+	return varsFlag(c).String()
+}
+
+func (c conflictsFlag) Set(s string) error {
+	key, policy, ok := strings.Cut(s, "=")
+	if !ok {
+		key, policy = anyKey, s
+	}
+	if !validConflictPolicy(policy) {
+		return fmt.Errorf("unknown conflict policy %q", policy)
+	}
+	c[key] = policy
+	return nil
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"go/scanner"
+	"io"
+)
+
+// fileError is an error that occurred while processing an input file.
+type fileError struct {
+	path string
+	err  error
+}
+
+// printDiagnostics writes errs grouped by file. Parse errors and malformed
+// directives are listed one per line with their file:line:col position.
+func printDiagnostics(w io.Writer, errs []fileError) {
+	for _, fe := range errs {
+		var list scanner.ErrorList
+		if !errors.As(fe.err, &list) {
+			fmt.Fprintf(w, "%s:\n\t%v\n", fe.path, fe.err)
+			continue
+		}
+		fmt.Fprintf(w, "%s: %d error(s)\n", fe.path, len(list))
+		for _, e := range list {
+			fmt.Fprintf(w, "\t%v\n", e)
+		}
+	}
+}
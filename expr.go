@@ -0,0 +1,317 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode"
+	"unicode/utf8"
+)
+
+// cond is a compiled condition of a directive or rule, e.g.
+// `repeated && type == 'string'`. Conditions compare the metadata of a field
+// with ==, != and the regular expression matches =~ and !~, and combine the
+// results with &&, || and !.
+type cond interface {
+	eval(field fieldInfo) interface{}
+}
+
+// condKinds are the kinds of the values of conditions.
+type condKind int
+
+const (
+	kindBool condKind = iota
+	kindString
+)
+
+func (k condKind) String() string {
+	if k == kindBool {
+		return "bool"
+	}
+	return "string"
+}
+
+// condVars are the metadata of a field that conditions can refer to.
+var condVars = map[string]struct {
+	kind  condKind
+	value func(field fieldInfo) interface{}
+}{
+	"struct":   {kindString, func(f fieldInfo) interface{} { return f.Struct }},
+	"field":    {kindString, func(f fieldInfo) interface{} { return f.Name }},
+	"go_type":  {kindString, func(f fieldInfo) interface{} { return f.Type }},
+	"file":     {kindString, func(f fieldInfo) interface{} { return f.File }},
+	"message":  {kindString, func(f fieldInfo) interface{} { return f.Message }},
+	"profile":  {kindString, func(f fieldInfo) interface{} { return f.Profile }},
+	"name":     {kindString, func(f fieldInfo) interface{} { return f.protobuf().Name }},
+	"type":     {kindString, func(f fieldInfo) interface{} { return f.protoType() }},
+	"protobuf": {kindBool, func(f fieldInfo) interface{} { return f.Protobuf != nil }},
+	"optional": {kindBool, func(f fieldInfo) interface{} { return f.protobuf().Cardinality == "optional" }},
+	"repeated": {kindBool, func(f fieldInfo) interface{} { return f.protobuf().Cardinality == "repeated" }},
+	"required": {kindBool, func(f fieldInfo) interface{} { return f.protobuf().Cardinality == "required" }},
+	"enum":     {kindBool, func(f fieldInfo) interface{} { return f.protobuf().Enum != "" }},
+	"oneof":    {kindBool, func(f fieldInfo) interface{} { return f.oneof() }},
+	"map":      {kindBool, func(f fieldInfo) interface{} { return f.protobuf().Map }},
+
+	"proto3_optional": {kindBool, func(f fieldInfo) interface{} { return f.proto3Optional() }},
+}
+
+type (
+	condLiteral struct{ value interface{} }
+	condVar     struct{ name string }
+	condNot     struct{ x cond }
+	condAnd     struct{ x, y cond }
+	condOr      struct{ x, y cond }
+	condEqual   struct {
+		x, y   cond
+		negate bool
+	}
+	condMatch struct {
+		x      cond
+		re     *regexp.Regexp
+		negate bool
+	}
+)
+
+func (c condLiteral) eval(fieldInfo) interface{}   { return c.value }
+func (c condVar) eval(field fieldInfo) interface{} { return condVars[c.name].value(field) }
+func (c condNot) eval(field fieldInfo) interface{} { return !c.x.eval(field).(bool) }
+func (c condAnd) eval(field fieldInfo) interface{} {
+	return c.x.eval(field).(bool) && c.y.eval(field).(bool)
+}
+func (c condOr) eval(field fieldInfo) interface{} {
+	return c.x.eval(field).(bool) || c.y.eval(field).(bool)
+}
+func (c condEqual) eval(field fieldInfo) interface{} {
+	return (c.x.eval(field) == c.y.eval(field)) != c.negate
+}
+func (c condMatch) eval(field fieldInfo) interface{} {
+	return c.re.MatchString(c.x.eval(field).(string)) != c.negate
+}
+
+// conds caches the compiled conditions.
+var conds sync.Map
+
+// compileCond compiles the condition src.
+func compileCond(src string) (cond, error) {
+	if c, ok := conds.Load(src); ok {
+		return c.(cond), nil
+	}
+	p := &condParser{src: src}
+	p.next()
+	c, kind, err := p.parseOr()
+	if err == nil && !p.eof() {
+		err = p.errorf("unexpected %q", p.tok)
+	}
+	if err == nil && kind != kindBool {
+		err = fmt.Errorf("condition %q is a string, not a bool", src)
+	}
+	if err != nil {
+		return nil, err
+	}
+	conds.Store(src, c)
+	return c, nil
+}
+
+// evalCond reports whether field satisfies the condition src, which an empty
+// condition always does. src must have been compiled without error before.
+func evalCond(src string, field fieldInfo) bool {
+	if src == "" {
+		return true
+	}
+	c, err := compileCond(src)
+	return err == nil && c.eval(field).(bool)
+}
+
+// condParser is a recursive descent parser of conditions.
+type condParser struct {
+	src string
+	pos int
+	// tok is the current token, and tokPos its offset in src. tok is "" at
+	// the end of src.
+	tok    string
+	tokPos int
+}
+
+// eof reports whether the current token is the end of src.
+func (p *condParser) eof() bool {
+	return p.tokPos == len(p.src)
+}
+
+func (p *condParser) errorf(format string, args ...interface{}) error {
+	return fmt.Errorf("condition %q: column %d: %s", p.src, p.tokPos+1, fmt.Sprintf(format, args...))
+}
+
+// next scans the next token.
+func (p *condParser) next() {
+	p.pos += len(p.src[p.pos:]) - len(strings.TrimLeftFunc(p.src[p.pos:], unicode.IsSpace))
+	p.tokPos = p.pos
+	rest := p.src[p.pos:]
+	switch {
+	case rest == "":
+		p.tok = ""
+	case rest[0] == '\'' || rest[0] == '"':
+		end := strings.IndexByte(rest[1:], rest[0])
+		if end < 0 {
+			p.tok = rest
+		} else {
+			p.tok = rest[:end+2]
+		}
+	case startsIdent(rest):
+		end := strings.IndexFunc(rest, func(r rune) bool { return !isIdent(r) })
+		if end < 0 {
+			end = len(rest)
+		}
+		p.tok = rest[:end]
+	default:
+		_, size := utf8.DecodeRuneInString(rest)
+		p.tok = rest[:size]
+		for _, op := range []string{"&&", "||", "==", "!=", "=~", "!~"} {
+			if strings.HasPrefix(rest, op) {
+				p.tok = op
+			}
+		}
+	}
+	p.pos += len(p.tok)
+}
+
+func isIdent(r rune) bool {
+	return r == '_' || unicode.IsLetter(r) || unicode.IsDigit(r)
+}
+
+// startsIdent reports whether s starts with a character of an identifier.
+func startsIdent(s string) bool {
+	r, _ := utf8.DecodeRuneInString(s)
+	return isIdent(r)
+}
+
+func (p *condParser) parseOr() (cond, condKind, error) {
+	return p.parseBinary("||", p.parseAnd, func(x, y cond) cond { return condOr{x, y} })
+}
+
+func (p *condParser) parseAnd() (cond, condKind, error) {
+	return p.parseBinary("&&", p.parseUnary, func(x, y cond) cond { return condAnd{x, y} })
+}
+
+// parseBinary parses operands joined by the boolean operator op.
+func (p *condParser) parseBinary(op string, operand func() (cond, condKind, error), join func(x, y cond) cond) (cond, condKind, error) {
+	x, kind, err := operand()
+	if err != nil {
+		return nil, 0, err
+	}
+	for p.tok == op {
+		if kind != kindBool {
+			return nil, 0, p.errorf("%s of a %s", op, kind)
+		}
+		p.next()
+		pos := p.tokPos
+		y, yKind, err := operand()
+		if err != nil {
+			return nil, 0, err
+		}
+		if yKind != kindBool {
+			p.tokPos = pos
+			return nil, 0, p.errorf("%s of a %s", op, yKind)
+		}
+		x = join(x, y)
+	}
+	return x, kind, nil
+}
+
+func (p *condParser) parseUnary() (cond, condKind, error) {
+	if p.tok != "!" {
+		return p.parseComparison()
+	}
+	p.next()
+	pos := p.tokPos
+	x, kind, err := p.parseUnary()
+	if err != nil {
+		return nil, 0, err
+	}
+	if kind != kindBool {
+		p.tokPos = pos
+		return nil, 0, p.errorf("! of a %s", kind)
+	}
+	return condNot{x}, kindBool, nil
+}
+
+func (p *condParser) parseComparison() (cond, condKind, error) {
+	x, kind, err := p.parsePrimary()
+	if err != nil {
+		return nil, 0, err
+	}
+	op := p.tok
+	switch op {
+	case "==", "!=":
+		p.next()
+		pos := p.tokPos
+		y, yKind, err := p.parsePrimary()
+		if err != nil {
+			return nil, 0, err
+		}
+		if yKind != kind {
+			p.tokPos = pos
+			return nil, 0, p.errorf("comparison of a %s with a %s", kind, yKind)
+		}
+		return condEqual{x: x, y: y, negate: op == "!="}, kindBool, nil
+	case "=~", "!~":
+		p.next()
+		pos := p.tokPos
+		y, yKind, err := p.parsePrimary()
+		if err != nil {
+			return nil, 0, err
+		}
+		literal, ok := y.(condLiteral)
+		if kind != kindString || yKind != kindString || !ok {
+			p.tokPos = pos
+			return nil, 0, p.errorf("%s needs a string and a string literal", op)
+		}
+		re, err := compileSelector(literal.value.(string))
+		if err != nil {
+			p.tokPos = pos
+			return nil, 0, p.errorf("%v", err)
+		}
+		return condMatch{x: x, re: re, negate: op == "!~"}, kindBool, nil
+	}
+	return x, kind, nil
+}
+
+func (p *condParser) parsePrimary() (cond, condKind, error) {
+	tok := p.tok
+	switch {
+	case p.eof():
+		return nil, 0, p.errorf("unexpected end of condition")
+	case tok == "":
+		return nil, 0, p.errorf("unexpected %q", p.src[p.tokPos:])
+	case tok == "(":
+		p.next()
+		x, kind, err := p.parseOr()
+		if err != nil {
+			return nil, 0, err
+		}
+		if p.tok != ")" {
+			return nil, 0, p.errorf("missing )")
+		}
+		p.next()
+		return x, kind, nil
+	case tok[0] == '\'' || tok[0] == '"':
+		if len(tok) < 2 || tok[len(tok)-1] != tok[0] {
+			return nil, 0, p.errorf("unterminated string")
+		}
+		p.next()
+		return condLiteral{tok[1 : len(tok)-1]}, kindString, nil
+	case tok == "true" || tok == "false":
+		p.next()
+		value, _ := strconv.ParseBool(tok)
+		return condLiteral{value}, kindBool, nil
+	case startsIdent(tok):
+		v, ok := condVars[tok]
+		if !ok {
+			return nil, 0, p.errorf("unknown name %q", tok)
+		}
+		p.next()
+		return condVar{tok}, v.kind, nil
+	}
+	return nil, 0, p.errorf("unexpected %q", tok)
+}
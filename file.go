@@ -1,23 +1,105 @@
 package main
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
 	"go/ast"
 	"go/parser"
+	"go/scanner"
 	"go/token"
+	"go/types"
 	"io"
+	"io/fs"
 	"os"
+	"path/filepath"
 	"regexp"
 	"strings"
 )
 
 var (
-	rComment = regexp.MustCompile(`^//.*?@(?i:gotags?|inject_tags?):\s*(.*)$`)
-	rInject  = regexp.MustCompile("`.+`$")
-	rTags    = regexp.MustCompile(`[\w_]+:"[^"]+"`)
-	rAll     = regexp.MustCompile(".*")
+	// rComment matches the directive of a comment, with its optional profiles
+	// in brackets and guard in parentheses, e.g.
+	// `@gotags[test](if="repeated"): validate:"dive"`.
+	rComment = regexp.MustCompile(`^//.*?@(?i:gotags?|inject_tags?)((?i:-use))?(\[[^\]]*\])?(\((?:[^()"]|"(?:[^"\\]|\\.)*")*\))?:\s*(.*)$`)
+	// rDirective finds where the directive of a comment matched by rComment
+	// starts.
+	rDirective = regexp.MustCompile(`@(?i:gotags?|inject_tags?)(?i:-use)?[\[(:]`)
+	rProfiles  = regexp.MustCompile(`^\[\s*[\w-]+(?:\s*,\s*[\w-]+)*\s*\]$`)
+	rGuard     = regexp.MustCompile(`^\(\s*if\s*=\s*("(?:[^"\\]|\\.)*")\s*\)$`)
+	rInject    = regexp.MustCompile("`.+`$")
+	rTags      = regexp.MustCompile(`[\w_]+:"[^"]+"`)
+	// https://go.dev/s/generatedcode
+	rGenerated = regexp.MustCompile(`^// Code generated .* DO NOT EDIT\.$`)
 )
 
+// bom is the UTF-8 byte order mark some editors put at the start of files.
+// The Go scanner skips it, but token positions still count its bytes, so the
+// offsets of areas stay byte offsets into the file as it is on disk.
+const bom = "\ufeff"
+
+// Modes select the files that tags are injected into.
+const (
+	// modeGenerated accepts files with a "Code generated ... DO NOT EDIT."
+	// header. It is the default.
+	modeGenerated = "generated"
+	// modeProtoc accepts files generated by protoc-gen-go.
+	modeProtoc = "protoc"
+	// modeGeneric accepts any Go file.
+	modeGeneric = "generic"
+)
+
+// options controls how a single file is injected.
+type options struct {
+	XXXSkip          []string `json:"xxx_skip,omitempty"`
+	RemoveTagComment bool     `json:"remove_tag_comment,omitempty"`
+	Mode             string   `json:"mode,omitempty"`
+	Format           string   `json:"format,omitempty"`
+	TagOrder         string   `json:"tag_order,omitempty"`
+	AlignTags        bool     `json:"align_tags,omitempty"`
+	// Profile selects the directives restricted to it, besides those for all
+	// profiles.
+	Profile string `json:"profile,omitempty"`
+	// StripProfiles removes the directives of the other profiles too, with
+	// RemoveTagComment.
+	StripProfiles bool `json:"strip_profiles,omitempty"`
+	// FlagVars are the variables given with -var, which take precedence over
+	// those of the config.
+	FlagVars map[string]string `json:"var,omitempty"`
+	// FlagConflicts are the conflict policies given with -conflict, which
+	// take precedence over those of the config.
+	FlagConflicts map[string]string `json:"conflict,omitempty"`
+	config
+
+	// log receives the verbose output about the file.
+	log *logger
+}
+
+// validate checks the options, whether they are given on the command line or
+// in a manifest entry.
+func (opts options) validate() error {
+	switch opts.Mode {
+	case "", modeGenerated, modeProtoc, modeGeneric:
+	default:
+		return fmt.Errorf("unknown mode %q", opts.Mode)
+	}
+	switch opts.Format {
+	case "", formatStructs, formatFile, formatNone:
+	default:
+		return fmt.Errorf("unknown format %q", opts.Format)
+	}
+	if opts.TagOrder != "" && strings.TrimSpace(strings.ReplaceAll(opts.TagOrder, ",", "")) == "" {
+		return fmt.Errorf("invalid tag order %q", opts.TagOrder)
+	}
+	if err := validateVars(opts.FlagVars); err != nil {
+		return err
+	}
+	if err := validateConflicts(opts.FlagConflicts); err != nil {
+		return err
+	}
+	return opts.config.validate()
+}
+
 type textArea struct {
 	Start        int
 	End          int
@@ -25,17 +107,60 @@ type textArea struct {
 	InjectTag    string
 	CommentStart int
 	CommentEnd   int
+	// Decl is the index of the declaration of the field's struct in the file.
+	Decl int
 }
 
-func parseFile(inputPath string, src interface{}, xxxSkip []string) (areas []textArea, err error) {
-	logf("parsing file %q for inject tag comments", inputPath)
+// processFile injects the custom tags of inputPath and writes the result to
+// outputPath.
+func processFile(inputPath, outputPath string, opts options) error {
+	areas, err := parseFile(inputPath, nil, opts)
+	if err != nil {
+		return err
+	}
+	return writeFile(inputPath, outputPath, areas, opts)
+}
+
+// parseFile finds the fields to inject custom tags into. If src is nil, the
+// contents are read from inputPath.
+func parseFile(inputPath string, src []byte, opts options) (areas []textArea, err error) {
+	if src == nil {
+		if src, err = os.ReadFile(inputPath); err != nil {
+			return
+		}
+	}
+	// -XXX_skip and rules apply to fields without a directive too
+	if len(opts.XXXSkip) == 0 && len(opts.Rules) == 0 && !hasDirective(src) {
+		opts.log.logf("file %q has no inject tag comments", inputPath)
+		return
+	}
+
+	generated, protocGenGo := generatedHeader(src)
+	switch {
+	case opts.Mode != modeGeneric && opts.Mode != modeProtoc && !generated:
+		opts.log.warnf("warn: skipping file %q without a \"Code generated ... DO NOT EDIT.\" header, use -force to inject it anyway", inputPath)
+		return
+	case opts.Mode == modeProtoc && !protocGenGo:
+		opts.log.warnf("warn: skipping file %q not generated by protoc-gen-go, use -force to inject it anyway", inputPath)
+		return
+	}
+
+	opts.log.logf("parsing file %q for inject tag comments", inputPath)
 	fset := token.NewFileSet()
 	f, err := parser.ParseFile(fset, inputPath, src, parser.ParseComments)
 	if err != nil {
 		return
 	}
 
-	for _, decl := range f.Decls {
+	// -XXX_skip is a rule applying before the configured ones
+	rules := opts.config
+	if len(opts.XXXSkip) > 0 {
+		rules.Rules = append([]rule{xxxSkipRule(opts.XXXSkip)}, rules.Rules...)
+	}
+	messages := protoMessages(src)
+
+	var errs scanner.ErrorList
+	for declIndex, decl := range f.Decls {
 		// check if is generic declaration
 		genDecl, ok := decl.(*ast.GenDecl)
 		if !ok {
@@ -61,29 +186,59 @@ func parseFile(inputPath string, src interface{}, xxxSkip []string) (areas []tex
 			continue
 		}
 
-		builder := strings.Builder{}
-		if len(xxxSkip) > 0 {
-			for i, skip := range xxxSkip {
-				builder.WriteString(fmt.Sprintf("%s:\"-\"", skip))
-				if i > 0 {
-					builder.WriteString(",")
-				}
+		structStart, injected := len(areas), false
+		for _, field := range structDecl.Fields.List {
+			// with -align_tags, the tags of every field of the struct may
+			// change, not only those with directives
+			if opts.AlignTags && field.Tag != nil {
+				areas = append(areas, textArea{
+					Start:      int(field.Pos()),
+					End:        int(field.End()),
+					CurrentTag: fieldTag(field),
+					Decl:       declIndex,
+				})
 			}
-		}
 
-		for _, field := range structDecl.Fields.List {
-			// skip if field has no doc
+			info := fieldInfo{
+				Struct:  typeSpec.Name.Name,
+				Type:    types.ExprString(field.Type),
+				File:    filepath.ToSlash(inputPath),
+				Profile: opts.Profile,
+			}
 			if len(field.Names) > 0 {
-				name := field.Names[0].Name
-				if len(xxxSkip) > 0 && strings.HasPrefix(name, "XXX") {
-					currentTag := field.Tag.Value
-					area := textArea{
+				info.Name = field.Names[0].Name
+			}
+			info.Message = messages[info.Struct]
+			if pt, ok := parseProtoTag(fieldTag(field)); ok {
+				info.Protobuf = &pt
+				if info.Message != "" && pt.Name != "" {
+					info.Proto = info.Message + "." + pt.Name
+				}
+			}
+
+			// rules match named fields only, and come before the directives,
+			// which override them
+			if info.Name != "" {
+				for _, ruleTags := range rules.match(info) {
+					tags, err := opts.expandTags(ruleTags)
+					if err == nil && malformedTag(tags) {
+						err = fmt.Errorf("malformed tags %q", tags)
+					}
+					if err == nil {
+						err = opts.checkConflicts(info, fieldTag(field), tags)
+					}
+					if err != nil {
+						errs.Add(fset.Position(field.Pos()), fmt.Sprintf("rule tags %q: %v", ruleTags, err))
+						continue
+					}
+					areas = append(areas, textArea{
 						Start:      int(field.Pos()),
 						End:        int(field.End()),
-						CurrentTag: currentTag[1 : len(currentTag)-1],
-						InjectTag:  builder.String(),
-					}
-					areas = append(areas, area)
+						CurrentTag: fieldTag(field),
+						InjectTag:  tags,
+						Decl:       declIndex,
+					})
+					injected = true
 				}
 			}
 
@@ -104,40 +259,182 @@ func parseFile(inputPath string, src interface{}, xxxSkip []string) (areas []tex
 			}
 
 			for _, comment := range comments {
-				tag := tagFromComment(comment.Text)
-				if tag == "" {
+				d, err := parseDirective(comment.Text)
+				if err != nil {
+					errs.Add(fset.Position(comment.Pos()), err.Error())
+					continue
+				}
+				if d.tag == "" {
+					continue
+				}
+
+				var c cond
+				if d.condition != "" {
+					if c, err = compileCond(d.condition); err != nil {
+						errs.Add(fset.Position(comment.Pos()), err.Error())
+						continue
+					}
+				}
+
+				// the macros and variables of directives that don't apply
+				// may only be defined for the builds they apply to
+				tag := d.tag
+				switch {
+				case !d.inProfile(opts.Profile):
+					opts.log.logf("directive %q is for profiles %q only", tag, d.profiles)
+					// the directives of other profiles are kept for the builds
+					// selecting them, unless asked otherwise
+					if !opts.RemoveTagComment || !opts.StripProfiles {
+						continue
+					}
+					tag = ""
+				case c != nil && !c.eval(info).(bool):
+					opts.log.logf("condition %q of directive %q is false", d.condition, tag)
+					// the comment of the directive is still removed
+					if !opts.RemoveTagComment {
+						continue
+					}
+					tag = ""
+				default:
+					if tag, err = opts.expandTags(tag); err != nil {
+						errs.Add(fset.Position(comment.Pos()), err.Error())
+						continue
+					}
+					if malformedTag(tag) {
+						errs.Add(fset.Position(comment.Pos()), fmt.Sprintf("malformed tag directive %q", tag))
+						continue
+					}
+				}
+				if err = opts.checkConflicts(info, fieldTag(field), tag); err != nil {
+					errs.Add(fset.Position(comment.Pos()), fmt.Sprintf("tag directive %q: %v", tag, err))
 					continue
 				}
 
 				if strings.Contains(comment.Text, "inject_tag") {
-					logf("warn: deprecated 'inject_tag' used")
+					opts.log.logf("warn: deprecated 'inject_tag' used")
 				}
 
-				currentTag := field.Tag.Value
 				area := textArea{
 					Start:        int(field.Pos()),
 					End:          int(field.End()),
-					CurrentTag:   currentTag[1 : len(currentTag)-1],
+					CurrentTag:   fieldTag(field),
 					InjectTag:    tag,
 					CommentStart: int(comment.Pos()),
 					CommentEnd:   int(comment.End()),
+					Decl:         declIndex,
 				}
 				areas = append(areas, area)
+				injected = true
 			}
 		}
+		if !injected {
+			areas = areas[:structStart]
+		}
+	}
+	if len(errs) > 0 {
+		return nil, errs
 	}
-	logf("parsed file %q, number of fields to inject custom tags: %d", inputPath, len(areas))
+	opts.log.logf("parsed file %q, number of fields to inject custom tags: %d", inputPath, len(areas))
 	return
 }
 
-func writeFile(inputPath string, areas []textArea, removeTagComment bool) (err error) {
+// fieldTag returns the tag of field without its quotes, or "" if it has none.
+func fieldTag(field *ast.Field) string {
+	if field.Tag == nil {
+		return ""
+	}
+	return field.Tag.Value[1 : len(field.Tag.Value)-1]
+}
+
+// generatedHeader reports whether the comments before the package clause of
+// src mark it as generated code, and whether they mention protoc-gen-go.
+func generatedHeader(src []byte) (generated, protocGenGo bool) {
+	src = bytes.TrimPrefix(src, []byte(bom))
+	for len(src) > 0 {
+		var line []byte
+		line, src, _ = bytes.Cut(src, []byte("\n"))
+		line = bytes.TrimSpace(line)
+		if len(line) == 0 {
+			continue
+		}
+		if !bytes.HasPrefix(line, []byte("//")) {
+			break
+		}
+		if rGenerated.Match(line) {
+			generated = true
+		}
+		if bytes.Contains(line, []byte("protoc-gen-go")) {
+			protocGenGo = true
+		}
+	}
+	return generated, generated && protocGenGo
+}
+
+// outputPath maps inputPath to its location under outputDir, keeping the
+// directory layout relative to sourceRoot. An empty outputDir means the file is
+// rewritten in place.
+func outputPath(inputPath, outputDir, sourceRoot string) (string, error) {
+	if outputDir == "" {
+		return inputPath, nil
+	}
+
+	absInput, err := filepath.Abs(inputPath)
+	if err != nil {
+		return "", err
+	}
+	absRoot, err := filepath.Abs(sourceRoot)
+	if err != nil {
+		return "", err
+	}
+
+	rel, err := filepath.Rel(absRoot, absInput)
+	if err != nil {
+		return "", err
+	}
+	if rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("input file %q is outside of source root %q", inputPath, sourceRoot)
+	}
+	return filepath.Join(outputDir, rel), nil
+}
+
+// rewrite is the injected content of an input file, ready to be written to
+// its output path.
+type rewrite struct {
+	input    string
+	output   string
+	contents []byte
+	// src is the input file, whose mode and ownership the output gets.
+	src fs.FileInfo
+	// changed is false if the output is already up to date.
+	changed bool
+	log     *logger
+}
+
+func writeFile(inputPath, outputPath string, areas []textArea, opts options) error {
+	rw, err := prepareFile(inputPath, outputPath, areas, opts)
+	if err != nil {
+		return err
+	}
+	return rw.commit()
+}
+
+// prepareFile injects areas into the contents of inputPath without writing
+// anything.
+func prepareFile(inputPath, outputPath string, areas []textArea, opts options) (rw rewrite, err error) {
 	f, err := os.Open(inputPath)
 	if err != nil {
 		return
 	}
 
-	contents, err := io.ReadAll(f)
+	finfo, err := f.Stat()
 	if err != nil {
+		f.Close()
+		return
+	}
+
+	original, err := io.ReadAll(f)
+	if err != nil {
+		f.Close()
 		return
 	}
 
@@ -145,18 +442,92 @@ func writeFile(inputPath string, areas []textArea, removeTagComment bool) (err e
 		return
 	}
 
-	// inject custom tags from tail of file first to preserve order
-	for i := range areas {
-		area := areas[len(areas)-i-1]
-		logf("inject custom tag %q to expression %q", area.InjectTag, string(contents[area.Start-1:area.End-1]))
-		contents = injectTag(contents, area, removeTagComment)
+	contents := rewriteContents(original, areas, opts)
+	if contents, err = formatContents(contents, areas, opts.Format); err != nil {
+		return rw, fmt.Errorf("formatting %q: %w", inputPath, err)
 	}
-	if err = os.WriteFile(inputPath, contents, 0o644); err != nil {
+
+	rw = rewrite{input: inputPath, output: outputPath, contents: contents, src: finfo, log: opts.log}
+
+	// leave files that are already up to date alone, so their modification
+	// time (and build caches depending on it) stay stable
+	current := original
+	if outputPath != inputPath {
+		current, err = os.ReadFile(outputPath)
+		if errors.Is(err, fs.ErrNotExist) {
+			rw.changed = true
+			return rw, nil
+		}
+		if err != nil {
+			return
+		}
+	}
+	rw.changed = !bytes.Equal(current, contents)
+	if !rw.changed {
+		opts.log.logf("file %q is up to date", outputPath)
+	}
+	return
+}
+
+// commit writes the rewritten contents to the output path.
+func (rw rewrite) commit() error {
+	if !rw.changed {
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(rw.output), 0o755); err != nil {
+		return err
+	}
+
+	if err := writeFileAtomic(rw.output, rw.contents, rw.src); err != nil {
+		return err
+	}
+	rw.log.logf("file %q is injected with custom tags", rw.output)
+	return nil
+}
+
+// writeFileAtomic replaces path with contents through a temporary file in the
+// same directory, so that readers never observe a partially written file. The
+// mode and, where permitted, the ownership of src are applied to the result.
+func writeFileAtomic(path string, contents []byte, src fs.FileInfo) error {
+	tmp, err := stageFile(path, contents, src)
+	if err != nil {
+		return err
+	}
+	if err = os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
+// stageFile writes contents to a synced temporary file next to path and
+// returns its name.
+func stageFile(path string, contents []byte, src fs.FileInfo) (tmp string, err error) {
+	f, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".tmp*")
+	if err != nil {
 		return
 	}
+	defer func() {
+		if err != nil {
+			f.Close()
+			os.Remove(f.Name())
+		}
+	}()
 
-	if len(areas) > 0 {
-		logf("file %q is injected with custom tags", inputPath)
+	if _, err = f.Write(contents); err != nil {
+		return
 	}
-	return
+	if err = f.Chmod(src.Mode().Perm()); err != nil {
+		return
+	}
+	if err = chown(f, src); err != nil {
+		return
+	}
+	if err = f.Sync(); err != nil {
+		return
+	}
+	if err = f.Close(); err != nil {
+		return
+	}
+	return f.Name(), nil
 }
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"go/ast"
+	"go/format"
+	"go/parser"
+	"go/printer"
+	"go/token"
+	"sort"
+)
+
+// Formats select what is re-formatted after injecting tags, as longer tags
+// break the alignment of the fields and comments of a struct.
+const (
+	// formatStructs re-formats the declarations of the structs whose fields
+	// have been injected. It is the default.
+	formatStructs = "structs"
+	// formatFile re-formats the whole file.
+	formatFile = "file"
+	// formatNone leaves the formatting alone.
+	formatNone = "none"
+)
+
+// formatContents formats src like gofmt would, according to mode. The
+// declarations of areas are the ones re-formatted for formatStructs. Line
+// endings and a byte order mark are kept.
+func formatContents(src []byte, areas []textArea, mode string) ([]byte, error) {
+	if mode == formatNone || (mode != formatFile && len(areas) == 0) {
+		return src, nil
+	}
+
+	// the printer always ends lines with "\n"
+	crlf := bytes.Count(src, []byte("\r\n")) == bytes.Count(src, []byte("\n"))
+	if crlf {
+		src = bytes.ReplaceAll(src, []byte("\r\n"), []byte("\n"))
+	}
+
+	var formatted []byte
+	var err error
+	if mode == formatFile {
+		hasBOM := bytes.HasPrefix(src, []byte(bom))
+		if formatted, err = format.Source(src); err != nil {
+			return nil, err
+		}
+		if hasBOM && !bytes.HasPrefix(formatted, []byte(bom)) {
+			formatted = append([]byte(bom), formatted...)
+		}
+	} else if formatted, err = formatDecls(src, areas); err != nil {
+		return nil, err
+	}
+
+	if crlf {
+		formatted = bytes.ReplaceAll(formatted, []byte("\n"), []byte("\r\n"))
+	}
+	return formatted, nil
+}
+
+// formatDecls re-formats the declarations of areas, and leaves the rest of src
+// as it is.
+func formatDecls(src []byte, areas []textArea) ([]byte, error) {
+	fset := token.NewFileSet()
+	f, err := parser.ParseFile(fset, "", src, parser.ParseComments)
+	if err != nil {
+		return nil, err
+	}
+
+	var indexes []int
+	seen := map[int]bool{}
+	for _, area := range areas {
+		if !seen[area.Decl] {
+			seen[area.Decl] = true
+			indexes = append(indexes, area.Decl)
+		}
+	}
+	sort.Ints(indexes)
+
+	var edits []edit
+	for _, i := range indexes {
+		if i >= len(f.Decls) {
+			return nil, fmt.Errorf("declaration #%d not found", i+1)
+		}
+		decl := f.Decls[i]
+
+		// only the comments inside the declaration belong to it
+		var comments []*ast.CommentGroup
+		for _, c := range f.Comments {
+			if c.Pos() >= decl.Pos() && c.End() <= decl.End() {
+				comments = append(comments, c)
+			}
+		}
+
+		var buf bytes.Buffer
+		if err = format.Node(&buf, fset, &printer.CommentedNode{Node: decl, Comments: comments}); err != nil {
+			return nil, err
+		}
+		edits = append(edits, edit{
+			start: fset.Position(decl.Pos()).Offset,
+			end:   fset.Position(decl.End()).Offset,
+			text:  buf.Bytes(),
+		})
+	}
+	return applyEdits(src, edits), nil
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// gitChangedFiles asks git, run in dir, for the files modified since ref, or
+// untracked, and, with staged set, for the files staged for commit. Deleted
+// files are left out. The paths are absolute, with symlinks resolved.
+func gitChangedFiles(dir, ref string, staged bool) (map[string]bool, error) {
+	root, err := git(dir, "rev-parse", "--show-toplevel")
+	if err != nil {
+		return nil, err
+	}
+	root = strings.TrimSpace(root)
+
+	var lists []string
+	if ref != "" {
+		modified, err := git(dir, "diff", "-z", "--name-only", "--diff-filter=d", ref, "--")
+		if err != nil {
+			return nil, err
+		}
+		untracked, err := git(dir, "ls-files", "-z", "--others", "--exclude-standard", "--full-name")
+		if err != nil {
+			return nil, err
+		}
+		lists = append(lists, modified, untracked)
+	}
+	if staged {
+		cached, err := git(dir, "diff", "-z", "--name-only", "--diff-filter=d", "--cached")
+		if err != nil {
+			return nil, err
+		}
+		lists = append(lists, cached)
+	}
+
+	changed := map[string]bool{}
+	for _, list := range lists {
+		for _, name := range strings.Split(list, "\x00") {
+			if name != "" {
+				changed[resolvePath(filepath.Join(root, filepath.FromSlash(name)))] = true
+			}
+		}
+	}
+	return changed, nil
+}
+
+// filterChanged returns the paths that are in changed.
+func filterChanged(paths []string, changed map[string]bool) []string {
+	var filtered []string
+	for _, path := range paths {
+		if changed[resolvePath(path)] {
+			filtered = append(filtered, path)
+		}
+	}
+	return filtered
+}
+
+// resolvePath makes path absolute and resolves its symlinks, as far as
+// possible, so that it can be compared with the paths reported by git.
+func resolvePath(path string) string {
+	if abs, err := filepath.Abs(path); err == nil {
+		path = abs
+	}
+	if resolved, err := filepath.EvalSymlinks(path); err == nil {
+		path = resolved
+	}
+	return path
+}
+
+func git(dir string, args ...string) (string, error) {
+	var stdout, stderr bytes.Buffer
+	cmd := exec.Command("git", append([]string{"-C", dir}, args...)...)
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	if err := cmd.Run(); err != nil {
+		return "", fmt.Errorf("git %s: %v: %s", strings.Join(args, " "), err, strings.TrimSpace(stderr.String()))
+	}
+	return stdout.String(), nil
+}
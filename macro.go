@@ -0,0 +1,112 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+var (
+	// rMacro matches the macro references of a tag, e.g. @pii or @len(1,64),
+	// and the quoted tag values, which can't have any.
+	rMacro = regexp.MustCompile(`"[^"]*"|@([\w-]+)(?:\(([^)]*)\))?`)
+	// rMacroParam matches the parameters of the body of a macro, $1 to $9.
+	rMacroParam = regexp.MustCompile(`\$([1-9])`)
+	rMacroName  = regexp.MustCompile(`^[\w-]+$`)
+)
+
+// expandMacros replaces the macro references of tag with the bodies of the
+// macros, their parameters replaced with the arguments of the references.
+func (c config) expandMacros(tag string) (string, error) {
+	if !strings.Contains(tag, "@") {
+		return tag, nil
+	}
+
+	var b strings.Builder
+	last := 0
+	for _, loc := range rMacro.FindAllStringSubmatchIndex(tag, -1) {
+		if loc[2] < 0 {
+			continue
+		}
+		name := tag[loc[2]:loc[3]]
+		body, ok := c.Macros[name]
+		if !ok {
+			return "", fmt.Errorf("undefined macro %q", name)
+		}
+		var args []string
+		if loc[4] >= 0 {
+			for _, arg := range strings.Split(tag[loc[4]:loc[5]], ",") {
+				args = append(args, strings.TrimSpace(arg))
+			}
+		}
+		if params := macroParams(body); len(args) != params {
+			return "", fmt.Errorf("macro %q takes %d argument(s), got %d", name, params, len(args))
+		}
+
+		b.WriteString(tag[last:loc[0]])
+		b.WriteString(rMacroParam.ReplaceAllStringFunc(body, func(param string) string {
+			i, _ := strconv.Atoi(param[1:])
+			return args[i-1]
+		}))
+		last = loc[1]
+	}
+	b.WriteString(tag[last:])
+	return b.String(), nil
+}
+
+// macroParams returns the number of parameters of the body of a macro, which
+// is the highest one it uses.
+func macroParams(body string) (params int) {
+	for _, match := range rMacroParam.FindAllStringSubmatch(body, -1) {
+		if i, _ := strconv.Atoi(match[1]); i > params {
+			params = i
+		}
+	}
+	return
+}
+
+// stripMacros removes the macro references of tag, to check the rest of it.
+func stripMacros(tag string) string {
+	return rMacro.ReplaceAllStringFunc(tag, func(s string) string {
+		if strings.HasPrefix(s, `"`) {
+			return s
+		}
+		return ""
+	})
+}
+
+// useToTag turns the list of macros of a @gotags-use directive, e.g.
+// "pii, len(1,64)", into macro references.
+func useToTag(use string) string {
+	var refs []string
+	depth, start := 0, 0
+	for i := 0; i <= len(use); i++ {
+		switch {
+		case i < len(use) && use[i] == '(':
+			depth++
+		case i < len(use) && use[i] == ')':
+			depth--
+		case i == len(use) || (use[i] == ',' && depth == 0):
+			if ref := strings.TrimSpace(use[start:i]); ref != "" {
+				refs = append(refs, "@"+ref)
+			}
+			start = i + 1
+		}
+	}
+	return strings.Join(refs, " ")
+}
+
+// validateMacros checks the names and bodies of the macros.
+func (c config) validateMacros() error {
+	for name, body := range c.Macros {
+		if !rMacroName.MatchString(name) {
+			return fmt.Errorf("invalid macro name %q", name)
+		}
+		tags := rMacroParam.ReplaceAllString(body, "x")
+		if strings.TrimSpace(tags) == "" || malformedTag(tags) {
+			return fmt.Errorf("macro %q: malformed tags %q", name, body)
+		}
+	}
+	return nil
+}
@@ -2,44 +2,281 @@ package main
 
 import (
 	"flag"
+	"fmt"
 	"log"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"runtime"
+	"sort"
 	"strings"
+	"syscall"
 )
 
 func main() {
-	var inputFiles, xxxTags string
-	var removeTagComment bool
+	var inputFiles, xxxTags, manifestPath, manifestResultPath, configPath, printConfigPath string
+	var cfg runConfig
+	var cacheFile string
+	var noCache, watchMode, staged, force bool
+	var changedSince string
+	var jobs int
 	flag.StringVar(&inputFiles, "input", "", "pattern to match input file(s)")
+	flag.StringVar(&cfg.outputDir, "output_dir", "", "directory to write injected file(s) to instead of rewriting them in place")
+	flag.StringVar(&cfg.sourceRoot, "source_root", ".", "root that input file paths are made relative to under -output_dir")
+	flag.StringVar(&configPath, "config", "", "YAML or TOML file with rules injecting tags into fields without a directive, instead of the .gotags.yaml files found next to the input file(s) and in their parent directories")
+	flag.StringVar(&printConfigPath, "print_config", "", "print the config that applies to this file, and exit")
+	flag.StringVar(&manifestPath, "manifest", "", "JSON manifest listing the files to inject, instead of -input")
+	flag.StringVar(&manifestResultPath, "manifest_result", "", "file to write the JSON result of each -manifest entry to")
+	flag.BoolVar(&cfg.transactional, "transactional", false, "write either all of the matched files or, if any of them fails, none of them")
+	flag.BoolVar(&cfg.keepGoing, "keep_going", false, "process every file even if some of them fail, and report all errors at the end")
+	flag.IntVar(&jobs, "j", runtime.GOMAXPROCS(0), "number of files to process concurrently")
+	flag.StringVar(&cacheFile, "cache_file", defaultCacheFile, "file to record the injected files in, so that unchanged ones are skipped on the next run")
+	flag.BoolVar(&noCache, "no_cache", false, "process every file, even those that are unchanged since the last run")
+	flag.BoolVar(&watchMode, "watch", false, "keep running, and re-inject the input file(s) whenever they are created or written")
+	flag.StringVar(&changedSince, "changed_since", "", "only process the input file(s) that git reports as modified since this ref, or untracked")
+	flag.BoolVar(&staged, "staged", false, "only process the input file(s) that git reports as staged for commit")
+	flag.StringVar(&cfg.opts.Mode, "mode", modeGenerated, "files to inject: \"generated\" ones with a \"Code generated ... DO NOT EDIT.\" header, \"protoc\" ones generated by protoc-gen-go, or \"generic\" for any Go file")
+	flag.StringVar(&cfg.opts.Format, "format", formatStructs, "re-format the injected file(s) like gofmt: \"structs\" re-formats the injected structs only, \"file\" the whole file, and \"none\" nothing")
+	flag.StringVar(&cfg.opts.TagOrder, "tag_order", orderPreserve, "order of the tags of injected fields: \"preserve\" keeps existing tags in place and appends new ones, \"sorted\" sorts them by key, \"protobuf-first\" puts the protobuf tags first and sorts the others, or a comma separated list of keys to put first")
+	flag.BoolVar(&cfg.opts.AlignTags, "align_tags", false, "align the tags of the fields of injected structs in columns, like the tagalign linter")
+	flag.BoolVar(&force, "force", false, "inject any Go file, same as -mode=generic")
 	flag.StringVar(&xxxTags, "XXX_skip", "", "tags that should be skipped (applies 'tag:\"-\"') for unknown fields (deprecated since protoc-gen-go v1.4.0)")
-	flag.BoolVar(&removeTagComment, "remove_tag_comment", false, "removes tag comments from the generated file(s)")
+	flag.BoolVar(&cfg.opts.RemoveTagComment, "remove_tag_comment", false, "removes tag comments from the generated file(s)")
+	flag.StringVar(&cfg.opts.Profile, "profile", "", "inject the directives restricted to this profile, e.g. @gotags[test]:, besides those for all profiles")
+	flag.BoolVar(&cfg.opts.StripProfiles, "strip_profiles", false, "with -remove_tag_comment, also remove the directives of the profiles that aren't selected")
 	flag.BoolVar(&verbose, "verbose", false, "verbose logging")
+	flagVars := varsFlag{}
+	flag.Var(flagVars, "var", "name=value variable that tags can refer to as ${name}, taking precedence over the vars of the config; can be repeated")
+	flagConflicts := conflictsFlag{}
+	flag.Var(flagConflicts, "conflict", "what to do when a tag sets a key the field already has: \"override\" it, \"keep-existing\", \"merge\" the comma separated options, or \"error\"; key=policy sets the policy of a single key; can be repeated")
 
 	flag.Parse()
 
-	var xxxSkipSlice []string
 	if len(xxxTags) > 0 {
 		logf("warn: deprecated flag '-XXX_skip' used")
-		xxxSkipSlice = strings.Split(xxxTags, ",")
+		cfg.opts.XXXSkip = strings.Split(xxxTags, ",")
+	}
+
+	if len(flagVars) > 0 {
+		cfg.opts.FlagVars = flagVars
+	}
+	if len(flagConflicts) > 0 {
+		cfg.opts.FlagConflicts = flagConflicts
+	}
+
+	if force {
+		cfg.opts.Mode = modeGeneric
+	}
+	if err := cfg.opts.validate(); err != nil {
+		log.Fatalf("%v, see: -help", err)
+	}
+
+	if configPath != "" {
+		c, err := loadConfig(configPath)
+		if err != nil {
+			log.Fatal(err)
+		}
+		cfg.opts.config = c
+	} else {
+		cfg.configs = newConfigFinder()
+	}
+
+	if printConfigPath != "" {
+		c, files := cfg.opts.config, []string{configPath}
+		if cfg.configs != nil {
+			var err error
+			if c, files, err = cfg.configs.find(printConfigPath); err != nil {
+				log.Fatal(err)
+			}
+		}
+		if err := printConfig(os.Stdout, printConfigPath, c, files); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	if manifestPath != "" {
+		runManifestMode(manifestPath, manifestResultPath, jobs, cfg.opts)
+		return
 	}
 
 	if inputFiles == "" {
 		log.Fatal("input file is mandatory, see: -help")
 	}
 
+	var err error
+	cfg.jobs = jobs
+	if !noCache {
+		if cfg.cache, err = loadCache(cacheFile); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if watchMode {
+		stop := make(chan struct{})
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+		go func() {
+			<-signals
+			close(stop)
+		}()
+		if err = watch(inputFiles, cfg, stop); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	paths, err := matchFiles(inputFiles)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if len(paths) == 0 {
+		log.Fatalf("input %q matched no files, see: -help", inputFiles)
+	}
+	if changedSince != "" || staged {
+		changed, err := gitChangedFiles(".", changedSince, staged)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if paths = filterChanged(paths, changed); len(paths) == 0 {
+			logf("no changed files match input %q", inputFiles)
+			return
+		}
+	}
+	if err = run(paths, cfg); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// runConfig holds the settings of an -input run.
+type runConfig struct {
+	outputDir     string
+	sourceRoot    string
+	transactional bool
+	keepGoing     bool
+	jobs          int
+	// cache is nil if caching is disabled.
+	cache *cache
+	// configs finds the config of each file, unless a -config is given.
+	configs *configFinder
+	opts    options
+}
+
+// run injects the custom tags of every path.
+func run(paths []string, cfg runConfig) error {
+	// every file is processed into its own slot, and logs and errors are
+	// reported in path order afterwards
+	rewrites := make([]rewrite, len(paths))
+	entries := make([]*cacheEntry, len(paths))
+	fileErrs := make([]error, len(paths))
+	logs := make([]*logger, len(paths))
+	forEach(len(paths), cfg.jobs, !cfg.keepGoing, func(i int) error {
+		opts := cfg.opts
+		opts.log = &logger{}
+		logs[i] = opts.log
+
+		rw, entry, err := prepareInput(paths[i], cfg, opts)
+		if err == nil && !cfg.transactional {
+			err = rw.commit()
+		}
+		rewrites[i], entries[i], fileErrs[i] = rw, entry, err
+		return err
+	})
+
+	var errs []fileError
+	for i, path := range paths {
+		logs[i].flush()
+		if fileErrs[i] == nil {
+			continue
+		}
+		if !cfg.keepGoing {
+			return fileErrs[i]
+		}
+		errs = append(errs, fileError{path: path, err: fileErrs[i]})
+	}
+
+	if len(errs) == 0 && cfg.transactional {
+		if err := commitAll(rewrites); err != nil {
+			return err
+		}
+	}
+
+	if cfg.cache != nil {
+		for i, path := range paths {
+			if fileErrs[i] == nil && entries[i] != nil {
+				cfg.cache.record(path, *entries[i])
+			}
+		}
+		cfg.cache.prune()
+		// the files are written already, failing to record them only costs
+		// the next run some time
+		if err := cfg.cache.save(); err != nil {
+			log.Printf("warn: can't save cache %q: %v", cfg.cache.path, err)
+		}
+	}
+
+	if len(errs) > 0 {
+		printDiagnostics(os.Stderr, errs)
+		return fmt.Errorf("%d of %d files failed", len(errs), len(paths))
+	}
+	return nil
+}
+
+// prepareInput parses path and injects its custom tags in memory. Unless
+// caching is disabled, it also returns the cache entry to record once the
+// result is written.
+func prepareInput(path string, cfg runConfig, opts options) (rw rewrite, entry *cacheEntry, err error) {
+	output, err := outputPath(path, cfg.outputDir, cfg.sourceRoot)
+	if err != nil {
+		return
+	}
+	if cfg.configs != nil {
+		if opts.config, _, err = cfg.configs.find(path); err != nil {
+			return
+		}
+	}
+	fingerprint := opts.fingerprint()
+
+	var inputHash string
+	if cfg.cache != nil {
+		var upToDate bool
+		if inputHash, upToDate, err = cfg.cache.upToDate(path, output, fingerprint); err != nil {
+			return
+		}
+		if upToDate {
+			opts.log.logf("file %q is unchanged since the last run", path)
+			cached := cfg.cache.Files[filepath.Clean(path)]
+			return rewrite{input: path, output: output}, &cached, nil
+		}
+	}
+
+	areas, err := parseFile(path, nil, opts)
+	if err != nil {
+		return
+	}
+	if rw, err = prepareFile(path, output, areas, opts); err != nil {
+		return
+	}
+	if cfg.cache != nil {
+		entry = &cacheEntry{Output: output, Options: fingerprint, InputHash: inputHash, OutputHash: hashBytes(rw.contents)}
+	}
+	return
+}
+
+// matchFiles returns the Go files matching pattern.
+func matchFiles(pattern string) ([]string, error) {
 	// Note: glob doesn't handle ** (treats as just one *). This will return
 	// files and folders, so we'll have to filter them out.
-	globResults, err := filepath.Glob(inputFiles)
+	globResults, err := filepath.Glob(pattern)
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
 
-	var matched int
+	var paths []string
 	for _, path := range globResults {
 		finfo, err := os.Stat(path)
 		if err != nil {
-			log.Fatal(err)
+			return nil, err
 		}
 
 		if finfo.IsDir() {
@@ -51,18 +288,30 @@ func main() {
 			continue
 		}
 
-		matched++
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	return paths, nil
+}
 
-		areas, err := parseFile(path, nil, xxxSkipSlice)
-		if err != nil {
+func runManifestMode(manifestPath, resultPath string, jobs int, opts options) {
+	entries, err := readManifest(manifestPath, opts)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	results, failed := runManifest(entries, jobs)
+	if resultPath != "" {
+		if err = writeManifestResults(resultPath, results); err != nil {
 			log.Fatal(err)
 		}
-		if err = writeFile(path, areas, removeTagComment); err != nil {
-			log.Fatal(err)
+	}
+	for _, result := range results {
+		if result.Error != "" {
+			log.Printf("%s: %s", result.Input, result.Error)
 		}
 	}
-
-	if matched == 0 {
-		log.Fatalf("input %q matched no files, see: -help", inputFiles)
+	if failed > 0 {
+		log.Fatalf("%d of %d manifest entries failed", failed, len(results))
 	}
 }
@@ -2,10 +2,21 @@ package main
 
 import (
 	"bytes"
+	"errors"
+	"fmt"
+	"go/format"
+	"go/scanner"
+	"io/fs"
 	"log"
 	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
 	"regexp"
+	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
 var (
@@ -53,7 +64,7 @@ func FuzzParseWriteFile(f *testing.F) {
 
 	f.Add(contents)
 	f.Fuzz(func(t *testing.T, orig []byte) {
-		areas, err := parseFile("placeholder.pb.go", orig, nil)
+		areas, err := parseFile("placeholder.pb.go", orig, options{})
 		if err == nil {
 			for _, area := range areas {
 				_ = injectTag(orig, area, false) // Test without annotation removal.
@@ -66,7 +77,7 @@ func FuzzParseWriteFile(f *testing.F) {
 func TestParseWriteFile(t *testing.T) {
 	expectedTag := `valid:"ip" yaml:"ip" json:"overrided"`
 
-	areas, err := parseFile(testInputFile, nil, nil)
+	areas, err := parseFile(testInputFile, nil, options{})
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -88,11 +99,11 @@ func TestParseWriteFile(t *testing.T) {
 	}
 	defer os.Remove(testInputFileTemp)
 
-	if err = writeFile(testInputFileTemp, areas, false); err != nil {
+	if err = writeFile(testInputFileTemp, testInputFileTemp, areas, options{}); err != nil {
 		t.Fatal(err)
 	}
 
-	newAreas, err := parseFile(testInputFileTemp, nil, nil)
+	newAreas, err := parseFile(testInputFileTemp, nil, options{})
 	if len(newAreas) != len(areas) {
 		t.Errorf("the comment tag has error")
 	}
@@ -116,7 +127,7 @@ func TestParseWriteFile(t *testing.T) {
 func TestParseWriteFileClearCommon(t *testing.T) {
 	expectedTag := `valid:"ip" yaml:"ip" json:"overrided"`
 
-	areas, err := parseFile(testInputFile, nil, nil)
+	areas, err := parseFile(testInputFile, nil, options{})
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -138,10 +149,10 @@ func TestParseWriteFileClearCommon(t *testing.T) {
 	}
 	defer os.Remove(testInputFileTemp)
 
-	if err = writeFile(testInputFileTemp, areas, true); err != nil {
+	if err = writeFile(testInputFileTemp, testInputFileTemp, areas, options{RemoveTagComment: true}); err != nil {
 		t.Fatal(err)
 	}
-	newAreas, err := parseFile(testInputFileTemp, nil, nil)
+	newAreas, err := parseFile(testInputFileTemp, nil, options{})
 	if newAreas != nil {
 		t.Errorf("not clear tag")
 	}
@@ -203,6 +214,49 @@ func TestNewTagItems(t *testing.T) {
 	}
 }
 
+func TestMultipleDirectives(t *testing.T) {
+	src := "// Code generated by protoc-gen-go. DO NOT EDIT.\n\npackage pb\n\ntype A struct {\n" +
+		"\t// @gotags: json:\"doc\" valid:\"a\"\n" +
+		"\tB string `json:\"b\"` // @gotags: json:\"trailing\" yaml:\"b\"\n" +
+		"}\n"
+	tests := []struct {
+		removeTagComment bool
+		expected         string
+	}{
+		{
+			expected: "\t// @gotags: json:\"doc\" valid:\"a\"\n" +
+				"\tB string `json:\"trailing\" valid:\"a\" yaml:\"b\"` // @gotags: json:\"trailing\" yaml:\"b\"\n",
+		},
+		{
+			removeTagComment: true,
+			expected:         "\tB string `json:\"trailing\" valid:\"a\" yaml:\"b\"`\n",
+		},
+	}
+
+	for _, test := range tests {
+		path := filepath.Join(t.TempDir(), "a.pb.go")
+		if err := os.WriteFile(path, []byte(src), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		// a second run must not change the result
+		for run := 1; run <= 2; run++ {
+			if err := processFile(path, path, options{RemoveTagComment: test.removeTagComment}); err != nil {
+				t.Fatal(err)
+			}
+			contents, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			expected := "// Code generated by protoc-gen-go. DO NOT EDIT.\n\npackage pb\n\ntype A struct {\n" +
+				test.expected + "}\n"
+			if string(contents) != expected {
+				t.Errorf("run %d with removeTagComment=%v: expected:\n%s\ngot:\n%s",
+					run, test.removeTagComment, expected, contents)
+			}
+		}
+	}
+}
+
 func TestContinueParsingWhenSkippingFields(t *testing.T) {
 	expectedTags := []string{
 		`valid:"ip" yaml:"ip" json:"overrided"`,
@@ -217,7 +271,7 @@ func TestContinueParsingWhenSkippingFields(t *testing.T) {
 		`tag:"bar"`,
 	}
 
-	areas, err := parseFile(testInputFile, nil, []string{"xml"})
+	areas, err := parseFile(testInputFile, nil, options{XXXSkip: []string{"xml"}})
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -242,7 +296,7 @@ func TestContinueParsingWhenSkippingFields(t *testing.T) {
 	}
 	defer os.Remove(testInputFileTemp)
 
-	if err = writeFile(testInputFileTemp, areas, false); err != nil {
+	if err = writeFile(testInputFileTemp, testInputFileTemp, areas, options{}); err != nil {
 		t.Fatal(err)
 	}
 
@@ -273,6 +327,1693 @@ func TestContinueParsingWhenSkippingFields(t *testing.T) {
 	}
 }
 
+var testsOutputPath = []struct {
+	input      string
+	outputDir  string
+	sourceRoot string
+	output     string
+	err        bool
+}{
+	{input: "pb/test.pb.go", outputDir: "", sourceRoot: ".", output: "pb/test.pb.go"},
+	{input: "pb/test.pb.go", outputDir: "out", sourceRoot: ".", output: filepath.Join("out", "pb", "test.pb.go")},
+	{input: "pb/test.pb.go", outputDir: "out", sourceRoot: "pb", output: filepath.Join("out", "test.pb.go")},
+	{input: "pb/test.pb.go", outputDir: "out", sourceRoot: "other", err: true},
+}
+
+var testsGeneratedHeader = []struct {
+	src         string
+	generated   bool
+	protocGenGo bool
+}{
+	{src: "// Code generated by protoc-gen-go. DO NOT EDIT.\n\npackage pb\n", generated: true, protocGenGo: true},
+	{src: "// Code generated by protoc-gen-go. DO NOT EDIT.\r\n// versions:\r\n\npackage pb\n", generated: true, protocGenGo: true},
+	{src: "// Code generated by mockgen. DO NOT EDIT.\npackage pb\n", generated: true},
+	{src: "// Copyright 2024\n\n// Code generated by stringer. DO NOT EDIT.\n\npackage pb\n", generated: true},
+	{src: "// Code generated by protoc-gen-go.\npackage pb\n", generated: false},
+	{src: "package pb\n\n// Code generated by protoc-gen-go. DO NOT EDIT.\n", generated: false},
+	{src: "// Package pb has hand-written code.\npackage pb\n", generated: false},
+}
+
+func TestGeneratedHeader(t *testing.T) {
+	for _, test := range testsGeneratedHeader {
+		generated, protocGenGo := generatedHeader([]byte(test.src))
+		if generated != test.generated || protocGenGo != test.protocGenGo {
+			t.Errorf("expected generated: %v, protoc-gen-go: %v for %q, got: %v, %v",
+				test.generated, test.protocGenGo, test.src, generated, protocGenGo)
+		}
+	}
+
+	src := []byte("package pb\n\ntype A struct {\n\tB string `json:\"b\"` // @gotags: valid:\"b\"\n}\n")
+	for mode, expected := range map[string]int{"": 0, modeGenerated: 0, modeProtoc: 0, modeGeneric: 1} {
+		areas, err := parseFile("a.go", src, options{Mode: mode})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(areas) != expected {
+			t.Errorf("mode %q: expected %d areas, got: %d", mode, expected, len(areas))
+		}
+	}
+}
+
+func TestLineEndingsAndBOM(t *testing.T) {
+	lf, err := os.ReadFile(testInputFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	variants := map[string]func([]byte) []byte{
+		"crlf": func(b []byte) []byte { return bytes.ReplaceAll(b, []byte("\n"), []byte("\r\n")) },
+		"bom":  func(b []byte) []byte { return append([]byte(bom), b...) },
+		"bom+crlf": func(b []byte) []byte {
+			return append([]byte(bom), bytes.ReplaceAll(b, []byte("\n"), []byte("\r\n"))...)
+		},
+	}
+
+	for _, removeTagComment := range []bool{false, true} {
+		opts := options{RemoveTagComment: removeTagComment}
+		areas, err := parseFile(testInputFile, lf, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected := rewriteContents(lf, areas, opts)
+
+		for name, convert := range variants {
+			src := convert(lf)
+			areas, err := parseFile(name+".pb.go", src, opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(areas) == 0 {
+				t.Fatalf("%s: no areas found", name)
+			}
+			result := rewriteContents(src, areas, opts)
+			if !bytes.Equal(result, convert(expected)) {
+				t.Errorf("%s (remove tag comment: %v): line endings or offsets are not preserved", name, removeTagComment)
+			}
+		}
+	}
+}
+
+func TestRemoveTagComment(t *testing.T) {
+	src := "// Code generated by protoc-gen-go. DO NOT EDIT.\n\npackage pb\n\ntype A struct {\n" +
+		"\tTrailing string `json:\"trailing\"` // @gotags: valid:\"a\"\n" +
+		"\t// @gotags: valid:\"b\"\n" +
+		"\tDoc string `json:\"doc\"`\n" +
+		"\t// Prose is kept.\n" +
+		"\t//\n" +
+		"\t// @gotags: valid:\"c\"\n" +
+		"\tProse string `json:\"prose\"`\n" +
+		"\t//\n" +
+		"\t// @gotags: valid:\"d\"\n" +
+		"\t//\n" +
+		"\t// @gotags: yaml:\"d\"\n" +
+		"\tEmpty string `json:\"empty\"`\n" +
+		"\tMixed string `json:\"mixed\"` // user id used for joins @gotags: db:\"user_id\"\n" +
+		"\t// First line of prose.\n" +
+		"\t// Second line of prose.   @gotags: valid:\"e\"\n" +
+		"\t// @gotags: yaml:\"e\"\n" +
+		"\tMixedDoc string `json:\"mixed_doc\"`\n" +
+		"}\n"
+	expected := "// Code generated by protoc-gen-go. DO NOT EDIT.\n\npackage pb\n\ntype A struct {\n" +
+		"\tTrailing string `json:\"trailing\" valid:\"a\"`\n" +
+		"\tDoc string `json:\"doc\" valid:\"b\"`\n" +
+		"\t// Prose is kept.\n" +
+		"\tProse string `json:\"prose\" valid:\"c\"`\n" +
+		"\tEmpty string `json:\"empty\" valid:\"d\" yaml:\"d\"`\n" +
+		"\tMixed string `json:\"mixed\" db:\"user_id\"` // user id used for joins\n" +
+		"\t// First line of prose.\n" +
+		"\t// Second line of prose.\n" +
+		"\tMixedDoc string `json:\"mixed_doc\" valid:\"e\" yaml:\"e\"`\n" +
+		"}\n"
+
+	for _, lineEnding := range []string{"\n", "\r\n"} {
+		src := strings.ReplaceAll(src, "\n", lineEnding)
+		expected := strings.ReplaceAll(expected, "\n", lineEnding)
+		areas, err := parseFile("a.pb.go", []byte(src), options{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		result := rewriteContents([]byte(src), areas, options{RemoveTagComment: true})
+		if string(result) != expected {
+			t.Errorf("expected:\n%s\ngot:\n%s", expected, result)
+		}
+	}
+}
+
+func TestTagItemsOrder(t *testing.T) {
+	items := newTagItems(`json:"a" protobuf_oneof:"b" yaml:"c" protobuf:"d" db:"e"`)
+	for _, test := range []struct {
+		policy   string
+		expected string
+	}{
+		{"", `json:"a" protobuf_oneof:"b" yaml:"c" protobuf:"d" db:"e"`},
+		{orderPreserve, `json:"a" protobuf_oneof:"b" yaml:"c" protobuf:"d" db:"e"`},
+		{orderSorted, `db:"e" json:"a" protobuf:"d" protobuf_oneof:"b" yaml:"c"`},
+		{orderProtobufFirst, `protobuf:"d" protobuf_oneof:"b" db:"e" json:"a" yaml:"c"`},
+		{"yaml, json", `yaml:"c" json:"a" db:"e" protobuf:"d" protobuf_oneof:"b"`},
+	} {
+		if result := items.order(test.policy).format(); result != test.expected {
+			t.Errorf("policy %q: expected %s, got %s", test.policy, test.expected, result)
+		}
+	}
+}
+
+func TestAlignTags(t *testing.T) {
+	src := "// Code generated by protoc-gen-go. DO NOT EDIT.\n\npackage pb\n\n" +
+		"type A struct {\n" +
+		"\tId string `json:\"id\"` // @gotags: db:\"id\"\n" +
+		"\tName string `json:\"name,omitempty\"`\n" +
+		"\tPlain string\n" +
+		"\tOther string `yaml:\"other\"`\n" +
+		"\n" +
+		"\tAfterBlank string `json:\"after_blank\" xml:\"x\"`\n" +
+		"}\n\n" +
+		"type B struct {\n" +
+		"\tUntouched string `json:\"untouched\"   db:\"u\"`\n" +
+		"}\n"
+	expected := "// Code generated by protoc-gen-go. DO NOT EDIT.\n\npackage pb\n\n" +
+		"type A struct {\n" +
+		"\tId    string `db:\"id\"               json:\"id\"`\n" +
+		"\tName  string `json:\"name,omitempty\"`\n" +
+		"\tPlain string\n" +
+		"\tOther string `yaml:\"other\"`\n" +
+		"\n" +
+		"\tAfterBlank string `json:\"after_blank\" xml:\"x\"`\n" +
+		"}\n\n" +
+		"type B struct {\n" +
+		"\tUntouched string `json:\"untouched\"   db:\"u\"`\n" +
+		"}\n"
+
+	opts := options{RemoveTagComment: true, TagOrder: orderSorted, AlignTags: true, Format: formatStructs}
+	areas, err := parseFile("a.pb.go", []byte(src), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, err := formatContents(rewriteContents([]byte(src), areas, opts), areas, opts.Format)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(result) != expected {
+		t.Errorf("expected:\n%s\ngot:\n%s", expected, result)
+	}
+}
+
+func TestFormatContents(t *testing.T) {
+	src := "// Code generated by protoc-gen-go. DO NOT EDIT.\n\npackage pb\n\n" +
+		"// A is injected.\n" +
+		"type A struct {\n" +
+		"\tShort  string `json:\"short\"`  // @gotags: valid:\"a_long_validation_rule\"\n" +
+		"\tLonger string `json:\"longer\"` // some comment\n" +
+		"}\n\n" +
+		"func  untouched( ) {}\n"
+
+	for _, lineEnding := range []string{"\n", "\r\n"} {
+		src := []byte(strings.ReplaceAll(src, "\n", lineEnding))
+		areas, err := parseFile("a.pb.go", src, options{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		injected := rewriteContents(src, areas, options{})
+
+		formatted, err := formatContents(injected, areas, formatStructs)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected := "\tShort  string `json:\"short\" valid:\"a_long_validation_rule\"` // @gotags: valid:\"a_long_validation_rule\"" + lineEnding +
+			"\tLonger string `json:\"longer\"`                               // some comment" + lineEnding
+		if !bytes.Contains(formatted, []byte(expected)) {
+			t.Errorf("struct is not formatted:\n%s", formatted)
+		}
+		if !bytes.Contains(formatted, []byte("func  untouched( ) {}")) {
+			t.Errorf("declaration without injected fields was formatted:\n%s", formatted)
+		}
+		if bytes.Count(formatted, []byte("\n")) != bytes.Count(formatted, []byte(lineEnding)) {
+			t.Errorf("line endings are not preserved:\n%q", formatted)
+		}
+
+		if formatted, err = formatContents(injected, areas, formatFile); err != nil {
+			t.Fatal(err)
+		}
+		gofmt, err := format.Source(bytes.ReplaceAll(formatted, []byte("\r\n"), []byte("\n")))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(gofmt, bytes.ReplaceAll(formatted, []byte("\r\n"), []byte("\n"))) {
+			t.Errorf("file is not formatted:\n%s", formatted)
+		}
+
+		if formatted, err = formatContents(injected, areas, formatNone); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(formatted, injected) {
+			t.Errorf("file was formatted")
+		}
+	}
+}
+
+func TestParseWriteFileFormatted(t *testing.T) {
+	for _, removeTagComment := range []bool{false, true} {
+		path := filepath.Join(t.TempDir(), "test.pb.go")
+		contents, err := os.ReadFile(testInputFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = os.WriteFile(path, contents, 0o644); err != nil {
+			t.Fatal(err)
+		}
+		if err = processFile(path, path, options{RemoveTagComment: removeTagComment}); err != nil {
+			t.Fatal(err)
+		}
+		if contents, err = os.ReadFile(path); err != nil {
+			t.Fatal(err)
+		}
+		gofmt, err := format.Source(contents)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(gofmt, contents) {
+			t.Errorf("injected file is not gofmt-clean (remove tag comment: %v)", removeTagComment)
+		}
+	}
+}
+
+func TestOutputPath(t *testing.T) {
+	for _, test := range testsOutputPath {
+		output, err := outputPath(test.input, test.outputDir, test.sourceRoot)
+		if test.err {
+			if err == nil {
+				t.Errorf("expected error for input %q with source root %q", test.input, test.sourceRoot)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if output != test.output {
+			t.Errorf("expected output path: %q, got: %q", test.output, output)
+		}
+	}
+}
+
+func TestWriteFileOutputDir(t *testing.T) {
+	original, err := os.ReadFile(testInputFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	areas, err := parseFile(testInputFile, nil, options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	output, err := outputPath(testInputFile, t.TempDir(), ".")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = writeFile(testInputFile, output, areas, options{}); err != nil {
+		t.Fatal(err)
+	}
+
+	contents, err := os.ReadFile(testInputFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(contents, original) {
+		t.Errorf("input file was modified")
+	}
+
+	newAreas, err := parseFile(output, nil, options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(newAreas) != len(areas) {
+		t.Errorf("expected %d areas in output file, got: %d", len(areas), len(newAreas))
+	}
+	contents, err = os.ReadFile(output)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectedExpr := "Address[ \t]+string[ \t]+`protobuf:\"bytes,1,opt,name=Address,proto3\" json:\"overrided\" valid:\"ip\" yaml:\"ip\"`"
+	if matched, err := regexp.Match(expectedExpr, contents); err != nil || !matched {
+		t.Error("output file doesn't contains custom tag after writing")
+	}
+}
+
+func TestWriteFilePreservesMode(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "test.pb.go")
+	contents, err := os.ReadFile(testInputFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = os.WriteFile(path, contents, 0o444); err != nil {
+		t.Fatal(err)
+	}
+	// os.WriteFile is subject to umask, make sure the mode is what we expect
+	if err = os.Chmod(path, 0o444); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = processFile(path, path, options{}); err != nil {
+		t.Fatal(err)
+	}
+	finfo, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if finfo.Mode().Perm() != 0o444 {
+		t.Errorf("expected mode %v, got: %v", fs.FileMode(0o444), finfo.Mode().Perm())
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Errorf("expected no temporary files to be left behind, got: %v", entries)
+	}
+
+	// a second run doesn't change anything, the file must not be rewritten
+	modTime := time.Unix(0, 0)
+	if err = os.Chtimes(path, modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+	if err = processFile(path, path, options{}); err != nil {
+		t.Fatal(err)
+	}
+	if finfo, err = os.Stat(path); err != nil {
+		t.Fatal(err)
+	}
+	if !finfo.ModTime().Equal(modTime) {
+		t.Errorf("unchanged file was rewritten")
+	}
+}
+
+func TestCommitAllRollback(t *testing.T) {
+	dir := t.TempDir()
+	original, err := os.ReadFile(testInputFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "test.pb.go")
+	if err = os.WriteFile(path, original, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	areas, err := parseFile(path, nil, options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rw, err := prepareFile(path, path, areas, options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the second output is a directory, so it can't be replaced
+	blocked := filepath.Join(dir, "blocked.pb.go")
+	if err = os.Mkdir(blocked, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	failing := rewrite{input: path, output: blocked, contents: rw.contents, src: rw.src, changed: true}
+
+	if err = commitAll([]rewrite{rw, failing}); err == nil {
+		t.Fatal("expected commit to fail")
+	}
+	contents, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(contents, original) {
+		t.Error("file was not rolled back")
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 {
+		t.Errorf("expected no temporary files to be left behind, got: %v", entries)
+	}
+
+	if err = commitAll([]rewrite{rw}); err != nil {
+		t.Fatal(err)
+	}
+	if contents, err = os.ReadFile(path); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(contents, rw.contents) {
+		t.Error("file was not committed")
+	}
+}
+
+func TestCommitAllInvalidResult(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.pb.go")
+	rw := rewrite{input: path, output: path, contents: []byte("package pb\n\ntype A struct {"), changed: true}
+	if err := commitAll([]rewrite{rw}); err == nil {
+		t.Error("expected invalid Go code to be rejected")
+	}
+	if _, err := os.Stat(path); !errors.Is(err, fs.ErrNotExist) {
+		t.Error("invalid result was written")
+	}
+}
+
+func TestParseFileMalformedDirectives(t *testing.T) {
+	src := `// Code generated by protoc-gen-go. DO NOT EDIT.
+
+package pb
+
+type A struct {
+	// @gotags: valid:"ip
+	Address string ` + "`json:\"address\"`" + `
+	Port    int32  ` + "`json:\"port\"`" + ` // @gotags: valid
+}
+`
+	_, err := parseFile("a.pb.go", []byte(src), options{})
+	var list scanner.ErrorList
+	if !errors.As(err, &list) {
+		t.Fatalf("expected a scanner.ErrorList, got: %v", err)
+	}
+	if len(list) != 2 {
+		t.Fatalf("expected 2 errors, got: %d", len(list))
+	}
+	expectedPositions := []string{"a.pb.go:6:2", "a.pb.go:8:31"}
+	for i, e := range list {
+		if e.Pos.String() != expectedPositions[i] {
+			t.Errorf("expected error at %s, got: %s", expectedPositions[i], e.Pos)
+		}
+	}
+
+	b := new(bytes.Buffer)
+	printDiagnostics(b, []fileError{
+		{path: "a.pb.go", err: err},
+		{path: "b.pb.go", err: errors.New("permission denied")},
+	})
+	expected := "a.pb.go: 2 error(s)\n" +
+		"\ta.pb.go:6:2: malformed tag directive \"valid:\\\"ip\"\n" +
+		"\ta.pb.go:8:31: malformed tag directive \"valid\"\n" +
+		"b.pb.go:\n\tpermission denied\n"
+	if b.String() != expected {
+		t.Errorf("expected diagnostics:\n%s\ngot:\n%s", expected, b.String())
+	}
+}
+
+func TestRunCache(t *testing.T) {
+	dir := t.TempDir()
+	original, err := os.ReadFile(testInputFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "test.pb.go")
+	if err = os.WriteFile(path, original, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	cacheFile := filepath.Join(dir, defaultCacheFile)
+	runWithCache := func(opts options) *cache {
+		c, err := loadCache(cacheFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = run([]string{path}, runConfig{jobs: 1, cache: c, opts: opts}); err != nil {
+			t.Fatal(err)
+		}
+		return c
+	}
+
+	c := runWithCache(options{})
+	inputHash, upToDate, err := c.upToDate(path, path, options{}.fingerprint())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !upToDate {
+		t.Error("expected injected file to be up to date")
+	}
+	if inputHash == hashBytes(original) {
+		t.Error("expected file to be injected")
+	}
+	if _, upToDate, _ = c.upToDate(path, path, options{RemoveTagComment: true}.fingerprint()); upToDate {
+		t.Error("expected file not to be up to date with different options")
+	}
+
+	// protoc regenerates the file
+	if err = os.WriteFile(path, original, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, upToDate, _ = c.upToDate(path, path, options{}.fingerprint()); upToDate {
+		t.Error("expected regenerated file not to be up to date")
+	}
+	runWithCache(options{})
+	contents, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(contents, original) {
+		t.Error("expected regenerated file to be injected again")
+	}
+
+	if err = os.Remove(path); err != nil {
+		t.Fatal(err)
+	}
+	c, err = loadCache(cacheFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.prune()
+	if len(c.Files) != 0 {
+		t.Errorf("expected deleted file to be pruned from the cache, got: %v", c.Files)
+	}
+}
+
+func TestRunCacheSaveError(t *testing.T) {
+	dir := t.TempDir()
+	contents, err := os.ReadFile(testInputFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "test.pb.go")
+	if err = os.WriteFile(path, contents, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := loadCache(filepath.Join(dir, "missing", defaultCacheFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = run([]string{path}, runConfig{jobs: 1, cache: c}); err != nil {
+		t.Fatalf("expected a cache that can't be saved not to fail the run, got: %v", err)
+	}
+	injected, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(injected, contents) {
+		t.Error("expected file to be injected")
+	}
+}
+
+func TestWatch(t *testing.T) {
+	dir := t.TempDir()
+	original, err := os.ReadFile(testInputFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first, second := filepath.Join(dir, "first.pb.go"), filepath.Join(dir, "second.pb.go")
+	if err = os.WriteFile(first, original, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	stop := make(chan struct{})
+	done := make(chan error)
+	go func() {
+		done <- watch(filepath.Join(dir, "*.pb.go"), runConfig{jobs: 1}, stop)
+	}()
+
+	waitInjected := func(path string) {
+		t.Helper()
+		for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+			contents, err := os.ReadFile(path)
+			if err == nil && bytes.Contains(contents, []byte(`json:"overrided" valid:"ip"`)) {
+				return
+			}
+		}
+		t.Fatalf("file %q was not injected", path)
+	}
+
+	// existing files are injected right away, new ones once written
+	waitInjected(first)
+	if err = os.WriteFile(second, original, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	waitInjected(second)
+
+	close(stop)
+	if err = <-done; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestWatchIgnoresOwnWrites(t *testing.T) {
+	dir := t.TempDir()
+	original, err := os.ReadFile(testInputFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "test.pb.go")
+	if err = os.WriteFile(path, original, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	// every run parses the file, which the verbose output tells
+	b := new(bytes.Buffer)
+	log.SetOutput(b)
+	verbose = true
+	defer func() {
+		log.SetOutput(os.Stderr)
+		verbose = false
+	}()
+
+	stop := make(chan struct{})
+	done := make(chan error)
+	go func() {
+		done <- watch(filepath.Join(dir, "*.pb.go"), runConfig{jobs: 1}, stop)
+	}()
+
+	// protoc writes the file once more, after the first run injected it
+	time.Sleep(2 * watchDebounce)
+	if err = os.WriteFile(path, original, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	// give the events of the tool's own write time to trigger a run
+	time.Sleep(4 * watchDebounce)
+
+	close(stop)
+	if err = <-done; err != nil {
+		t.Fatal(err)
+	}
+	if runs := strings.Count(b.String(), fmt.Sprintf("parsing file %q", path)); runs != 2 {
+		t.Errorf("expected 2 runs, one per write by protoc, got: %d\n%s", runs, b)
+	}
+}
+
+func TestGitChangedFiles(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not installed")
+	}
+
+	dir := t.TempDir()
+	gitRun := func(args ...string) {
+		t.Helper()
+		if _, err := git(dir, args...); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeFile := func(name string) string {
+		t.Helper()
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte("package pb\n// "+name+"\n"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+
+	gitRun("init", "-q")
+	gitRun("config", "user.email", "test@example.com")
+	gitRun("config", "user.name", "test")
+	modified, deleted, unchanged := writeFile("modified.pb.go"), writeFile("deleted.pb.go"), writeFile("unchanged.pb.go")
+	gitRun("add", ".")
+	gitRun("commit", "-q", "-m", "initial")
+
+	if err := os.WriteFile(modified, []byte("package pb\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(deleted); err != nil {
+		t.Fatal(err)
+	}
+	untracked, added := writeFile("untracked.pb.go"), writeFile("added.pb.go")
+	gitRun("add", added)
+	paths := []string{added, deleted, modified, unchanged, untracked}
+
+	changed, err := gitChangedFiles(dir, "HEAD", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{added, modified, untracked}
+	if filtered := filterChanged(paths, changed); !reflect.DeepEqual(filtered, expected) {
+		t.Errorf("expected files changed since HEAD: %v, got: %v", expected, filtered)
+	}
+
+	if changed, err = gitChangedFiles(dir, "", true); err != nil {
+		t.Fatal(err)
+	}
+	expected = []string{added}
+	if filtered := filterChanged(paths, changed); !reflect.DeepEqual(filtered, expected) {
+		t.Errorf("expected staged files: %v, got: %v", expected, filtered)
+	}
+
+	if _, err = gitChangedFiles(dir, "no-such-ref", false); err == nil {
+		t.Error("expected error for unknown ref")
+	}
+}
+
+func TestManifest(t *testing.T) {
+	dir := t.TempDir()
+	output := filepath.Join(dir, "test.pb.go")
+	manifest := filepath.Join(dir, "manifest.json")
+	err := os.WriteFile(manifest, []byte(`[
+		{"input": "./pb/test.pb.go", "output": "`+output+`", "options": {"remove_tag_comment": true}},
+		{"input": "./pb/missing.pb.go", "output": "`+filepath.Join(dir, "missing.pb.go")+`"}
+	]`), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	entries, err := readManifest(manifest, options{XXXSkip: []string{"xml"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 {
+		t.Fatalf("expected 2 manifest entries, got: %d", len(entries))
+	}
+	if !entries[0].opts.RemoveTagComment || len(entries[0].opts.XXXSkip) != 1 {
+		t.Errorf("entry options are not merged with defaults: %+v", entries[0].opts)
+	}
+
+	results, failed := runManifest(entries, 2)
+	if failed != 1 {
+		t.Errorf("expected 1 failed entry, got: %d", failed)
+	}
+	if results[0].Error != "" || results[1].Error == "" {
+		t.Errorf("unexpected results: %+v", results)
+	}
+
+	areas, err := parseFile(output, nil, options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(areas) != 0 {
+		t.Errorf("expected tag comments to be removed from output, got %d areas", len(areas))
+	}
+}
+
+func TestManifestEntryOptions(t *testing.T) {
+	manifest := filepath.Join(t.TempDir(), "manifest.json")
+	err := os.WriteFile(manifest, []byte(`[
+		{"input": "a.pb.go", "options": {"rules": [{"field": "A", "tags": "db:\"a\""}], "vars": {"x": "1"}, "xxx_skip": ["yaml"]}},
+		{"input": "b.pb.go"}
+	]`), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defaults := options{XXXSkip: []string{"xml"}}
+	defaults.Rules = []rule{{Field: "B", Tags: `db:"b"`}}
+	defaults.Vars = map[string]string{"base": "b"}
+	entries, err := readManifest(manifest, defaults)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	first := entries[0].opts
+	if len(first.Rules) != 2 || first.Rules[0].Field != "B" || first.Rules[1].Field != "A" {
+		t.Errorf("expected the rules of the entry after the defaults, got: %+v", first.Rules)
+	}
+	if !reflect.DeepEqual(first.Vars, map[string]string{"base": "b", "x": "1"}) {
+		t.Errorf("expected the vars of the entry merged with the defaults, got: %v", first.Vars)
+	}
+	if !reflect.DeepEqual(first.XXXSkip, []string{"yaml"}) {
+		t.Errorf("expected the xxx_skip of the entry, got: %v", first.XXXSkip)
+	}
+
+	// neither the defaults nor the other entries see the options of an entry
+	for _, opts := range []options{defaults, entries[1].opts} {
+		if len(opts.Rules) != 1 || opts.Rules[0].Field != "B" {
+			t.Errorf("expected the default rules only, got: %+v", opts.Rules)
+		}
+		if !reflect.DeepEqual(opts.Vars, map[string]string{"base": "b"}) {
+			t.Errorf("expected the default vars only, got: %v", opts.Vars)
+		}
+		if !reflect.DeepEqual(opts.XXXSkip, []string{"xml"}) {
+			t.Errorf("expected the default xxx_skip only, got: %v", opts.XXXSkip)
+		}
+	}
+}
+
+func TestManifestInvalidOptions(t *testing.T) {
+	for _, opts := range []string{
+		`{"mode": "nope"}`,
+		`{"format": "bogus"}`,
+		`{"tag_order": " , "}`,
+		`{"var": {"a b": "c"}}`,
+		`{"conflict": {"*": "wat"}}`,
+	} {
+		manifest := filepath.Join(t.TempDir(), "manifest.json")
+		err := os.WriteFile(manifest, []byte(`[{"input": "a.pb.go", "options": `+opts+`}]`), 0o644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err = readManifest(manifest, options{}); err == nil {
+			t.Errorf("expected error for manifest options %s", opts)
+		}
+	}
+}
+
+func TestManifestUnknownOption(t *testing.T) {
+	manifest := filepath.Join(t.TempDir(), "manifest.json")
+	err := os.WriteFile(manifest, []byte(`[{"input": "a.pb.go", "options": {"remove_tag_coment": true}}]`), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = readManifest(manifest, options{}); err == nil {
+		t.Error("expected error for unknown manifest option")
+	}
+}
+
+const rulesSrc = "// Code generated by protoc-gen-go. DO NOT EDIT.\n\npackage pb\n\n" +
+	"type User struct {\n" +
+	"\tEmail string `protobuf:\"bytes,1,opt,name=email,proto3\" json:\"email,omitempty\"`\n" +
+	"\tAccountId string `protobuf:\"bytes,2,opt,name=account_id,proto3\" json:\"account_id,omitempty\"`\n" +
+	"\t// @gotags: db:\"name\"\n" +
+	"\tName string `protobuf:\"bytes,3,opt,name=name,proto3\" json:\"name,omitempty\"`\n" +
+	"}\n\n" +
+	"var file_user_proto_goTypes = []interface{}{\n" +
+	"\t(*User)(nil), // 0: acme.user.v1.User\n" +
+	"}\n"
+
+func TestConfigRules(t *testing.T) {
+	yamlConfig := `
+rules:
+  - match: acme.user.v1.User.email
+    tags: validate:"email"
+  - match: acme.*.*.*.*_id
+    tags: db:"account"
+  - match: User.Name
+    tags: db:"ignored" validate:"required"
+`
+	tomlConfig := `
+[[rules]]
+match = "acme.user.v1.User.email"
+tags = 'validate:"email"'
+
+[[rules]]
+match = "acme.*.*.*.*_id"
+tags = 'db:"account"'
+
+[[rules]]
+match = "User.Name"
+tags = 'db:"ignored" validate:"required"'
+`
+	expected := "// Code generated by protoc-gen-go. DO NOT EDIT.\n\npackage pb\n\n" +
+		"type User struct {\n" +
+		"\tEmail     string `protobuf:\"bytes,1,opt,name=email,proto3\" json:\"email,omitempty\" validate:\"email\"`\n" +
+		"\tAccountId string `protobuf:\"bytes,2,opt,name=account_id,proto3\" json:\"account_id,omitempty\" db:\"account\"`\n" +
+		"\t// @gotags: db:\"name\"\n" +
+		"\tName string `protobuf:\"bytes,3,opt,name=name,proto3\" json:\"name,omitempty\" db:\"name\" validate:\"required\"`\n" +
+		"}\n\n" +
+		"var file_user_proto_goTypes = []interface{}{\n" +
+		"\t(*User)(nil), // 0: acme.user.v1.User\n" +
+		"}\n"
+
+	for name, test := range map[string]struct {
+		config string
+		isTOML bool
+	}{"yaml": {yamlConfig, false}, "toml": {tomlConfig, true}} {
+		c, err := parseConfig([]byte(test.config), test.isTOML)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		opts := options{Format: formatStructs, config: c}
+		areas, err := parseFile("user.pb.go", []byte(rulesSrc), opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		result, err := formatContents(rewriteContents([]byte(rulesSrc), areas, opts), areas, opts.Format)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(result) != expected {
+			t.Errorf("%s: expected:\n%s\ngot:\n%s", name, expected, result)
+		}
+	}
+}
+
+func TestInvalidConfig(t *testing.T) {
+	for _, config := range []string{
+		"rule:\n  - match: User.Name\n    tags: db:\"name\"\n",
+		"rules:\n  - tags: db:\"name\"\n",
+		"rules:\n  - match: User.[\n    tags: db:\"name\"\n",
+		"rules:\n  - match: User.Name\n    tags: db:name\n",
+	} {
+		if _, err := parseConfig([]byte(config), false); err == nil {
+			t.Errorf("expected error for config %q", config)
+		}
+	}
+}
+
+func TestRegexpRules(t *testing.T) {
+	src := "// Code generated by protoc-gen-go. DO NOT EDIT.\n\npackage pb\n\n" +
+		"type Event struct {\n" +
+		"\tCreatedAt *timestamppb.Timestamp `json:\"created_at\"`\n" +
+		"\tPayload []byte `json:\"payload\"`\n" +
+		"\tLabels map[string]*structpb.Value `json:\"labels\"`\n" +
+		"\tXXX_unrecognized []byte `json:\"-\"`\n" +
+		"}\n\n" +
+		"type Other struct {\n" +
+		"\tUpdatedAt *timestamppb.Timestamp `json:\"updated_at\"`\n" +
+		"}\n"
+	expected := "// Code generated by protoc-gen-go. DO NOT EDIT.\n\npackage pb\n\n" +
+		"type Event struct {\n" +
+		"\tCreatedAt *timestamppb.Timestamp `json:\"created_at\" swaggertype:\"string\" format:\"date-time\"`\n" +
+		"\tPayload []byte `json:\"payload\" swaggertype:\"string\" format:\"byte\"`\n" +
+		"\tLabels map[string]*structpb.Value `json:\"labels\" event:\"labels\"`\n" +
+		"\tXXX_unrecognized []byte `json:\"-\" xml:\"-\" yaml:\"-\" swaggertype:\"string\" format:\"byte\"`\n" +
+		"}\n\n" +
+		"type Other struct {\n" +
+		"\tUpdatedAt *timestamppb.Timestamp `json:\"updated_at\" swaggertype:\"string\" format:\"date-time\"`\n" +
+		"}\n"
+
+	c, err := parseConfig([]byte(`
+rules:
+  - type: \*timestamppb\.Timestamp
+    tags: swaggertype:"string" format:"date-time"
+  - type: '\[\]byte'
+    tags: swaggertype:"string" format:"byte"
+  - struct: Event
+    type: map\[.*
+    field: L.*
+    tags: event:"labels"
+  - struct: Ev
+    tags: event:"partial"
+`), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts := options{XXXSkip: []string{"xml", "yaml"}, config: c}
+	areas, err := parseFile("event.pb.go", []byte(src), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result := rewriteContents([]byte(src), areas, opts); string(result) != expected {
+		t.Errorf("expected:\n%s\ngot:\n%s", expected, result)
+	}
+
+	if _, err = parseConfig([]byte("rules:\n  - type: '[]byte'\n    tags: a:\"b\"\n"), false); err == nil {
+		t.Error("expected error for invalid regular expression")
+	}
+}
+
+func TestParseProtoTag(t *testing.T) {
+	for _, test := range []struct {
+		tag      string
+		expected protoTag
+		ok       bool
+	}{
+		{`protobuf:"bytes,1,opt,name=address,proto3" json:"address,omitempty"`,
+			protoTag{Wire: "bytes", Number: 1, Cardinality: "optional", Name: "address", JSONName: "address", Proto3: true}, true},
+		{`protobuf:"varint,2,rep,packed,name=kinds,json=allKinds,proto3,enum=acme.Kind"`,
+			protoTag{Wire: "varint", Number: 2, Cardinality: "repeated", Name: "kinds", JSONName: "allKinds", Enum: "acme.Kind", Proto3: true, Packed: true}, true},
+		{`protobuf:"bytes,3,rep,name=labels,proto3" protobuf_key:"bytes,1,opt,name=key,proto3" protobuf_val:"bytes,2,opt,name=value,proto3"`,
+			protoTag{Wire: "bytes", Number: 3, Cardinality: "repeated", Name: "labels", JSONName: "labels", Proto3: true, Map: true}, true},
+		{`protobuf:"zigzag64,4,req,name=id"`,
+			protoTag{Wire: "zigzag64", Number: 4, Cardinality: "required", Name: "id", JSONName: "id"}, true},
+		{`protobuf:"varint,5,opt,name=bar,proto3,oneof"`,
+			protoTag{Wire: "varint", Number: 5, Cardinality: "optional", Name: "bar", JSONName: "bar", Proto3: true, Oneof: true}, true},
+		{`protobuf_oneof:"foo_bar"`, protoTag{Name: "foo_bar", Oneof: true}, true},
+		{`json:"name"`, protoTag{}, false},
+	} {
+		pt, ok := parseProtoTag(test.tag)
+		if ok != test.ok || pt != test.expected {
+			t.Errorf("%s: expected %+v, %v, got %+v, %v", test.tag, test.expected, test.ok, pt, ok)
+		}
+	}
+}
+
+func TestProtobufRules(t *testing.T) {
+	src := "// Code generated by protoc-gen-go. DO NOT EDIT.\n\npackage pb\n\n" +
+		"type Order struct {\n" +
+		"\tItems []string `protobuf:\"bytes,1,rep,name=items,proto3\"`\n" +
+		"\tKind Kind `protobuf:\"varint,2,opt,name=kind,proto3,enum=acme.Kind\"`\n" +
+		"\tLabels map[string]string `protobuf:\"bytes,3,rep,name=labels,proto3\" protobuf_key:\"bytes,1,opt,name=key,proto3\" protobuf_val:\"bytes,2,opt,name=value,proto3\"`\n" +
+		"\tNote string `json:\"note\"`\n" +
+		"}\n"
+	expected := "// Code generated by protoc-gen-go. DO NOT EDIT.\n\npackage pb\n\n" +
+		"type Order struct {\n" +
+		"\tItems []string `protobuf:\"bytes,1,rep,name=items,proto3\" validate:\"dive\"`\n" +
+		"\tKind Kind `protobuf:\"varint,2,opt,name=kind,proto3,enum=acme.Kind\" swaggertype:\"string\"`\n" +
+		"\tLabels map[string]string `protobuf:\"bytes,3,rep,name=labels,proto3\" protobuf_key:\"bytes,1,opt,name=key,proto3\" protobuf_val:\"bytes,2,opt,name=value,proto3\" map:\"labels\"`\n" +
+		"\tNote string `json:\"note\"`\n" +
+		"}\n"
+
+	c, err := parseConfig([]byte(`
+rules:
+  - protobuf:
+      cardinality: repeated
+      map: false
+    tags: validate:"dive"
+  - protobuf:
+      enum: .*
+    tags: swaggertype:"string"
+  - protobuf:
+      map: true
+      number: 3
+    tags: map:"labels"
+  - protobuf:
+      wire: fixed.*
+    tags: fixed:"true"
+`), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts := options{config: c}
+	areas, err := parseFile("order.pb.go", []byte(src), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result := rewriteContents([]byte(src), areas, opts); string(result) != expected {
+		t.Errorf("expected:\n%s\ngot:\n%s", expected, result)
+	}
+}
+
+func TestCompileCond(t *testing.T) {
+	field := fieldInfo{
+		Struct:   "Order",
+		Name:     "Items",
+		Type:     "[]string",
+		Message:  "acme.Order",
+		File:     "gen/order.pb.go",
+		Protobuf: &protoTag{Wire: "bytes", Number: 1, Cardinality: "repeated", Name: "items"},
+	}
+	for _, test := range []struct {
+		src      string
+		expected bool
+	}{
+		{`repeated && type=='string'`, true},
+		{`repeated && type == "bytes"`, false},
+		{`!repeated || map`, false},
+		{`!(optional || enum) && protobuf`, true},
+		{`go_type == '[]string' && name != 'id'`, true},
+		{`message =~ 'acme\..*' && file !~ '.*_test.*'`, true},
+		{`struct == 'Order' && field =~ 'It.*' && !oneof && !required`, true},
+		{`repeated == true`, true},
+		{"repeated\t&&\ttype == 'string'", true},
+		{"repeated &&\n  type == 'string'\n", true},
+		{"(\n  optional\n  || map\n)\n", false},
+	} {
+		c, err := compileCond(test.src)
+		if err != nil {
+			t.Errorf("%s: %v", test.src, err)
+			continue
+		}
+		if result := c.eval(field).(bool); result != test.expected {
+			t.Errorf("%s: expected %v, got %v", test.src, test.expected, result)
+		}
+	}
+
+	for _, src := range []string{
+		``,
+		`type`,
+		`repeated &&`,
+		`repeated && type`,
+		`type == true`,
+		`unknown == 'x'`,
+		`(repeated`,
+		`type == 'string`,
+		`type =~ field`,
+		`type =~ '['`,
+		`repeated = true`,
+		`!type`,
+		`repeated →garbage`,
+		`repeated && ≠`,
+		"repeated \xe2",
+	} {
+		if _, err := compileCond(src); err == nil {
+			t.Errorf("expected error for condition %q", src)
+		}
+	}
+}
+
+func TestConditionalDirectives(t *testing.T) {
+	src := "// Code generated by protoc-gen-go. DO NOT EDIT.\n\npackage pb\n\n" +
+		"type Order struct {\n" +
+		"\t// @gotags(if=\"repeated && type=='string'\"): validate:\"dive,max=64\"\n" +
+		"\tItems []string `protobuf:\"bytes,1,rep,name=items,proto3\"`\n" +
+		"\t// @gotags(if=\"repeated && type=='string'\"): validate:\"dive,max=64\"\n" +
+		"\tIds []int64 `protobuf:\"varint,2,rep,packed,name=ids,proto3\"`\n" +
+		"\tNote string `protobuf:\"bytes,3,opt,name=note,proto3\"` // @gotags( if = \"field == \\\"Note\\\"\" ): db:\"note\"\n" +
+		"\tCache string // @gotags(if=\"protobuf\"): db:\"cache\"\n" +
+		"}\n"
+	expected := "// Code generated by protoc-gen-go. DO NOT EDIT.\n\npackage pb\n\n" +
+		"type Order struct {\n" +
+		"\tItems []string `protobuf:\"bytes,1,rep,name=items,proto3\" validate:\"dive,max=64\"`\n" +
+		"\tIds []int64 `protobuf:\"varint,2,rep,packed,name=ids,proto3\" validate:\"max=8\"`\n" +
+		"\tNote string `protobuf:\"bytes,3,opt,name=note,proto3\" db:\"note\"`\n" +
+		"\tCache string\n" +
+		"}\n"
+
+	c, err := parseConfig([]byte(`
+rules:
+  - if: |
+      repeated &&
+      type == 'int64'
+    tags: validate:"max=8"
+`), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts := options{RemoveTagComment: true, config: c}
+	areas, err := parseFile("order.pb.go", []byte(src), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result := rewriteContents([]byte(src), areas, opts); string(result) != expected {
+		t.Errorf("expected:\n%s\ngot:\n%s", expected, result)
+	}
+
+	if _, err = parseConfig([]byte("rules:\n  - if: repeated &&\n    tags: a:\"b\"\n"), false); err == nil {
+		t.Error("expected error for invalid rule condition")
+	}
+
+	src = "// Code generated by protoc-gen-go. DO NOT EDIT.\n\npackage pb\n\n" +
+		"type A struct {\n" +
+		"\t// @gotags(iff=\"repeated\"): a:\"b\"\n" +
+		"\tB string\n" +
+		"\tC string // @gotags(if=\"unknown\"): a:\"b\"\n" +
+		"}\n"
+	_, err = parseFile("a.pb.go", []byte(src), options{})
+	var list scanner.ErrorList
+	if !errors.As(err, &list) || len(list) != 2 {
+		t.Fatalf("expected 2 errors, got: %v", err)
+	}
+	for i, pos := range []string{"a.pb.go:6:2", "a.pb.go:8:11"} {
+		if list[i].Pos.String() != pos {
+			t.Errorf("expected error at %s, got: %s", pos, list[i].Pos)
+		}
+	}
+}
+
+func TestProto3Optional(t *testing.T) {
+	src := "// Code generated by protoc-gen-go. DO NOT EDIT.\n\npackage pb\n\n" +
+		"type User struct {\n" +
+		"\tName string `protobuf:\"bytes,1,opt,name=name,proto3\"`\n" +
+		"\tNick *string `protobuf:\"bytes,2,opt,name=nick,proto3,oneof\"`\n" +
+		"\tContact isUser_Contact `protobuf_oneof:\"contact\"`\n" +
+		"}\n\n" +
+		"type User_Email struct {\n" +
+		"\tEmail string `protobuf:\"bytes,3,opt,name=email,proto3,oneof\"`\n" +
+		"}\n\n" +
+		"var file_user_proto_goTypes = []interface{}{\n" +
+		"\t(*User)(nil), // 0: acme.User\n" +
+		"}\n"
+	expected := "// Code generated by protoc-gen-go. DO NOT EDIT.\n\npackage pb\n\n" +
+		"type User struct {\n" +
+		"\tName string `protobuf:\"bytes,1,opt,name=name,proto3\" optional:\"true\"`\n" +
+		"\tNick *string `protobuf:\"bytes,2,opt,name=nick,proto3,oneof\" optional:\"true\" proto3_optional:\"true\"`\n" +
+		"\tContact isUser_Contact `protobuf_oneof:\"contact\" oneof:\"true\" selector:\"true\"`\n" +
+		"}\n\n" +
+		"type User_Email struct {\n" +
+		"\tEmail string `protobuf:\"bytes,3,opt,name=email,proto3,oneof\" optional:\"true\" oneof:\"true\" selector:\"true\"`\n" +
+		"}\n\n" +
+		"var file_user_proto_goTypes = []interface{}{\n" +
+		"\t(*User)(nil), // 0: acme.User\n" +
+		"}\n"
+
+	c, err := parseConfig([]byte(`
+rules:
+  - if: optional
+    tags: optional:"true"
+  - if: proto3_optional
+    tags: proto3_optional:"true"
+  - if: oneof
+    tags: oneof:"true"
+  - protobuf:
+      oneof: true
+    tags: selector:"true"
+`), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts := options{config: c}
+	areas, err := parseFile("user.pb.go", []byte(src), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result := rewriteContents([]byte(src), areas, opts); string(result) != expected {
+		t.Errorf("expected:\n%s\ngot:\n%s", expected, result)
+	}
+}
+
+func TestProfiles(t *testing.T) {
+	src := "// Code generated by protoc-gen-go. DO NOT EDIT.\n\npackage pb\n\n" +
+		"type User struct {\n" +
+		"\t// @gotags[test]: faker:\"email\"\n" +
+		"\t// @gotags[db, migrations]: gorm:\"uniqueIndex\"\n" +
+		"\t// @gotags: valid:\"email\"\n" +
+		"\tEmail string `json:\"email\"`\n" +
+		"\tName string `json:\"name\"` // @gotags[test](if=\"profile == 'test' && field == 'Name'\"): faker:\"name\"\n" +
+		"\tNick string // @gotags[test]: faker:\"username\"\n" +
+		"}\n"
+	for _, test := range []struct {
+		opts     options
+		expected string
+	}{
+		{
+			options{Profile: "test"},
+			"\t// @gotags[test]: faker:\"email\"\n" +
+				"\t// @gotags[db, migrations]: gorm:\"uniqueIndex\"\n" +
+				"\t// @gotags: valid:\"email\"\n" +
+				"\tEmail string `json:\"email\" faker:\"email\" valid:\"email\"`\n" +
+				"\tName string `json:\"name\" faker:\"name\"` // @gotags[test](if=\"profile == 'test' && field == 'Name'\"): faker:\"name\"\n" +
+				"\tNick string `faker:\"username\"` // @gotags[test]: faker:\"username\"\n",
+		},
+		{
+			options{Profile: "migrations", RemoveTagComment: true},
+			"\t// @gotags[test]: faker:\"email\"\n" +
+				"\tEmail string `json:\"email\" gorm:\"uniqueIndex\" valid:\"email\"`\n" +
+				"\tName string `json:\"name\"` // @gotags[test](if=\"profile == 'test' && field == 'Name'\"): faker:\"name\"\n" +
+				"\tNick string // @gotags[test]: faker:\"username\"\n",
+		},
+		{
+			options{RemoveTagComment: true, StripProfiles: true},
+			"\tEmail string `json:\"email\" valid:\"email\"`\n" +
+				"\tName string `json:\"name\"`\n" +
+				"\tNick string\n",
+		},
+	} {
+		areas, err := parseFile("user.pb.go", []byte(src), test.opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected := "// Code generated by protoc-gen-go. DO NOT EDIT.\n\npackage pb\n\ntype User struct {\n" + test.expected + "}\n"
+		if result := rewriteContents([]byte(src), areas, test.opts); string(result) != expected {
+			t.Errorf("profile %q: expected:\n%s\ngot:\n%s", test.opts.Profile, expected, result)
+		}
+	}
+
+	if _, err := parseDirective(`// @gotags[]: a:"b"`); err == nil {
+		t.Error("expected error for empty profiles")
+	}
+}
+
+func TestMacros(t *testing.T) {
+	c, err := parseConfig([]byte(`
+macros:
+  pii: log:"redact" json:"-" gdpr:"personal"
+  len: validate:"min=$1,max=$2"
+  required: binding:"required"
+rules:
+  - field: Id
+    tags: '@required db:"id"'
+`), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	src := "// Code generated by protoc-gen-go. DO NOT EDIT.\n\npackage pb\n\n" +
+		"type User struct {\n" +
+		"\tId string `json:\"id\"`\n" +
+		"\t// @gotags: @pii\n" +
+		"\tEmail string `json:\"email\"`\n" +
+		"\t// @gotags-use: pii, len(1,64)\n" +
+		"\tName string `json:\"name\"`\n" +
+		"\tNick string `json:\"nick\"` // @gotags: @len(2, 16) doc:\"@len(1,2)\"\n" +
+		"}\n"
+	expected := "// Code generated by protoc-gen-go. DO NOT EDIT.\n\npackage pb\n\n" +
+		"type User struct {\n" +
+		"\tId string `json:\"id\" binding:\"required\" db:\"id\"`\n" +
+		"\tEmail string `json:\"-\" log:\"redact\" gdpr:\"personal\"`\n" +
+		"\tName string `json:\"-\" log:\"redact\" gdpr:\"personal\" validate:\"min=1,max=64\"`\n" +
+		"\tNick string `json:\"nick\" validate:\"min=2,max=16\" doc:\"@len(1,2)\"`\n" +
+		"}\n"
+	opts := options{RemoveTagComment: true, config: c}
+	areas, err := parseFile("user.pb.go", []byte(src), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result := rewriteContents([]byte(src), areas, opts); string(result) != expected {
+		t.Errorf("expected:\n%s\ngot:\n%s", expected, result)
+	}
+
+	src = "// Code generated by protoc-gen-go. DO NOT EDIT.\n\npackage pb\n\n" +
+		"type A struct {\n" +
+		"\t// @gotags: @unknown\n" +
+		"\tB string\n" +
+		"\tC string // @gotags-use: len(1)\n" +
+		"}\n"
+	_, err = parseFile("a.pb.go", []byte(src), opts)
+	var list scanner.ErrorList
+	if !errors.As(err, &list) || len(list) != 2 {
+		t.Fatalf("expected 2 errors, got: %v", err)
+	}
+	for i, pos := range []string{"a.pb.go:6:2", "a.pb.go:8:11"} {
+		if list[i].Pos.String() != pos {
+			t.Errorf("expected error at %s, got: %s", pos, list[i].Pos)
+		}
+	}
+
+	overlay := config{Macros: map[string]string{"pii": `json:"-"`}}
+	if merged := c.merge(overlay); merged.Macros["pii"] != `json:"-"` || merged.Macros["required"] != `binding:"required"` {
+		t.Errorf("unexpected merged macros: %v", merged.Macros)
+	}
+	if _, err = parseConfig([]byte("macros:\n  pii: redact\n"), false); err == nil {
+		t.Error("expected error for malformed macro")
+	}
+}
+
+func TestVars(t *testing.T) {
+	c, err := parseConfig([]byte(`
+vars:
+  uuid_type: uuid
+  table: users
+macros:
+  pk: gorm:"primaryKey;type:${uuid_type}"
+rules:
+  - field: Name
+    tags: db:"${table}.name"
+`), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	flagVars := varsFlag{}
+	if err = flagVars.Set("uuid_type=char(36)"); err != nil {
+		t.Fatal(err)
+	}
+
+	src := "// Code generated by protoc-gen-go. DO NOT EDIT.\n\npackage pb\n\n" +
+		"type User struct {\n" +
+		"\tId string `json:\"id\"` // @gotags: @pk\n" +
+		"\tName string `json:\"name\"`\n" +
+		"\tOrg string `json:\"org\"` // @gotags: gorm:\"type:${uuid_type}\" fk:\"${table}\"\n" +
+		"}\n"
+	for _, test := range []struct {
+		flagVars map[string]string
+		uuidType string
+	}{{nil, "uuid"}, {flagVars, "char(36)"}} {
+		expected := "// Code generated by protoc-gen-go. DO NOT EDIT.\n\npackage pb\n\n" +
+			"type User struct {\n" +
+			"\tId string `json:\"id\" gorm:\"primaryKey;type:" + test.uuidType + "\"`\n" +
+			"\tName string `json:\"name\" db:\"users.name\"`\n" +
+			"\tOrg string `json:\"org\" gorm:\"type:" + test.uuidType + "\" fk:\"users\"`\n" +
+			"}\n"
+		opts := options{RemoveTagComment: true, FlagVars: test.flagVars, config: c}
+		areas, err := parseFile("user.pb.go", []byte(src), opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if result := rewriteContents([]byte(src), areas, opts); string(result) != expected {
+			t.Errorf("expected:\n%s\ngot:\n%s", expected, result)
+		}
+	}
+
+	src = "// Code generated by protoc-gen-go. DO NOT EDIT.\n\npackage pb\n\n" +
+		"type A struct {\n" +
+		"\tB string // @gotags: db:\"${undefined}\"\n" +
+		"}\n"
+	_, err = parseFile("a.pb.go", []byte(src), options{config: c})
+	var list scanner.ErrorList
+	if !errors.As(err, &list) || len(list) != 1 {
+		t.Fatalf("expected 1 error, got: %v", err)
+	}
+	if pos := list[0].Pos.String(); pos != "a.pb.go:6:11" || !strings.Contains(list[0].Msg, `"undefined"`) {
+		t.Errorf("unexpected error at %s: %s", pos, list[0].Msg)
+	}
+
+	for _, v := range []string{"uuid_type", "=x", "a b=c"} {
+		if err = flagVars.Set(v); err == nil {
+			t.Errorf("expected error for -var %q", v)
+		}
+	}
+}
+
+func TestProfileVars(t *testing.T) {
+	src := "// Code generated by protoc-gen-go. DO NOT EDIT.\n\npackage pb\n\n" +
+		"type User struct {\n" +
+		"\t// @gotags[mysql]: gorm:\"type:${mysql_type}\" @mysql_index\n" +
+		"\t// @gotags(if=\"profile == 'mysql'\"): db:\"${mysql_column}\"\n" +
+		"\tId string `json:\"id\"`\n" +
+		"}\n"
+	for _, test := range []struct {
+		opts     options
+		expected string
+	}{
+		{
+			options{Profile: "pg", RemoveTagComment: true},
+			"\t// @gotags[mysql]: gorm:\"type:${mysql_type}\" @mysql_index\n" +
+				"\tId string `json:\"id\"`\n",
+		},
+		{
+			options{
+				Profile:          "mysql",
+				RemoveTagComment: true,
+				FlagVars:         map[string]string{"mysql_type": "char(36)", "mysql_column": "id"},
+				config:           config{Macros: map[string]string{"mysql_index": `index:"true"`}},
+			},
+			"\tId string `json:\"id\" gorm:\"type:char(36)\" index:\"true\" db:\"id\"`\n",
+		},
+	} {
+		areas, err := parseFile("user.pb.go", []byte(src), test.opts)
+		if err != nil {
+			t.Fatalf("profile %q: %v", test.opts.Profile, err)
+		}
+		expected := "// Code generated by protoc-gen-go. DO NOT EDIT.\n\npackage pb\n\ntype User struct {\n" + test.expected + "}\n"
+		if result := rewriteContents([]byte(src), areas, test.opts); string(result) != expected {
+			t.Errorf("profile %q: expected:\n%s\ngot:\n%s", test.opts.Profile, expected, result)
+		}
+	}
+
+	// the directives that apply still need their variables
+	_, err := parseFile("user.pb.go", []byte(src), options{Profile: "mysql"})
+	var list scanner.ErrorList
+	if !errors.As(err, &list) || len(list) != 2 {
+		t.Fatalf("expected 2 errors, got: %v", err)
+	}
+}
+
+func TestConflictPolicies(t *testing.T) {
+	src := "// Code generated by protoc-gen-go. DO NOT EDIT.\n\npackage pb\n\n" +
+		"type User struct {\n" +
+		"\tName string `protobuf:\"bytes,1,opt,name=name,proto3\" json:\"name,omitempty\" validate:\"required\"` // @gotags: json:\"full_name\" validate:\"max=64\" db:\"name\"\n" +
+		"}\n"
+	for _, test := range []struct {
+		opts     options
+		expected string
+	}{
+		{options{}, "`protobuf:\"bytes,1,opt,name=name,proto3\" json:\"full_name\" validate:\"max=64\" db:\"name\"`"},
+		{options{FlagConflicts: map[string]string{anyKey: conflictKeepExisting}}, "`protobuf:\"bytes,1,opt,name=name,proto3\" json:\"name,omitempty\" validate:\"required\" db:\"name\"`"},
+		{
+			options{config: config{Conflicts: map[string]string{anyKey: conflictKeepExisting, "validate": conflictMerge}}},
+			"`protobuf:\"bytes,1,opt,name=name,proto3\" json:\"name,omitempty\" validate:\"required,max=64\" db:\"name\"`",
+		},
+		{
+			options{FlagConflicts: map[string]string{"validate": conflictOverride}, config: config{Conflicts: map[string]string{"validate": conflictMerge}}},
+			"`protobuf:\"bytes,1,opt,name=name,proto3\" json:\"full_name\" validate:\"max=64\" db:\"name\"`",
+		},
+	} {
+		areas, err := parseFile("user.pb.go", []byte(src), test.opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		result := rewriteContents([]byte(src), areas, test.opts)
+		// injecting the result again must not change it
+		if areas, err = parseFile("user.pb.go", result, test.opts); err != nil {
+			t.Fatal(err)
+		}
+		result = rewriteContents(result, areas, test.opts)
+		expected := "// Code generated by protoc-gen-go. DO NOT EDIT.\n\npackage pb\n\n" +
+			"type User struct {\n\tName string " + test.expected + " // @gotags: json:\"full_name\" validate:\"max=64\" db:\"name\"\n}\n"
+		if string(result) != expected {
+			t.Errorf("%+v: expected:\n%s\ngot:\n%s", test.opts, expected, result)
+		}
+	}
+
+	src = "// Code generated by protoc-gen-go. DO NOT EDIT.\n\npackage pb\n\n" +
+		"type A struct {\n" +
+		"\t// @gotags: protobuf:\"bytes,1,opt,name=b,proto3\"\n" +
+		"\tB string `protobuf:\"bytes,1,opt,name=b,proto3\"`\n" +
+		"\tC isA_C `protobuf_oneof:\"c\"` // @gotags: protobuf_oneof:\"typo\"\n" +
+		"\tD string `json:\"d\"` // @gotags: json:\"e\"\n" +
+		"}\n"
+	_, err := parseFile("a.pb.go", []byte(src), options{FlagConflicts: map[string]string{"json": conflictError}})
+	var list scanner.ErrorList
+	if !errors.As(err, &list) || len(list) != 2 {
+		t.Fatalf("expected 2 errors, got: %v", err)
+	}
+	for i, pos := range []string{"a.pb.go:8:31", "a.pb.go:9:22"} {
+		if list[i].Pos.String() != pos {
+			t.Errorf("expected error at %s, got: %s", pos, list[i].Pos)
+		}
+	}
+	if !strings.Contains(list[0].Msg, "A.C") || !strings.Contains(list[0].Msg, `"protobuf_oneof"`) {
+		t.Errorf("expected the error to name the field and key, got: %s", list[0].Msg)
+	}
+
+	opts := options{config: config{Conflicts: map[string]string{"protobuf_oneof": conflictOverride}}}
+	if _, err = parseFile("a.pb.go", []byte(src), opts); err != nil {
+		t.Errorf("expected no error with an explicit policy, got: %v", err)
+	}
+	if _, err = parseConfig([]byte("conflicts:\n  json: replace\n"), false); err == nil {
+		t.Error("expected error for unknown conflict policy")
+	}
+}
+
+func TestConfigDiscovery(t *testing.T) {
+	root := t.TempDir()
+	for path, contents := range map[string]string{
+		".gotags.yaml":       "rules:\n  - match: User.Email\n    tags: validate:\"email\"\n  - match: User.AccountId\n    tags: db:\"base\"\n",
+		"svc/.gotags.toml":   "[[rules]]\nmatch = \"User.AccountId\"\ntags = 'db:\"svc\"'\n",
+		"svc/user.pb.go":     rulesSrc,
+		"other/user.pb.go":   rulesSrc,
+		"broken/.gotags.yml": "rules: [\n",
+		"broken/user.pb.go":  rulesSrc,
+	} {
+		path = filepath.Join(root, path)
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(contents), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	finder := newConfigFinder()
+	c, files, err := finder.find(filepath.Join(root, "svc", "user.pb.go"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectedFiles := []string{filepath.Join(root, ".gotags.yaml"), filepath.Join(root, "svc", ".gotags.toml")}
+	if !reflect.DeepEqual(files, expectedFiles) {
+		t.Errorf("expected config files %v, got %v", expectedFiles, files)
+	}
+
+	var printed strings.Builder
+	if err = printConfig(&printed, "svc/user.pb.go", c, files); err != nil {
+		t.Fatal(err)
+	}
+	expected := "# config of svc/user.pb.go\n" +
+		"# from " + expectedFiles[0] + "\n" +
+		"# from " + expectedFiles[1] + "\n" +
+		"rules:\n" +
+		"  - match: User.Email\n    tags: validate:\"email\"\n" +
+		"  - match: User.AccountId\n    tags: db:\"base\"\n" +
+		"  - match: User.AccountId\n    tags: db:\"svc\"\n"
+	if printed.String() != expected {
+		t.Errorf("expected:\n%s\ngot:\n%s", expected, printed.String())
+	}
+
+	if _, _, err = finder.find(filepath.Join(root, "broken", "user.pb.go")); err == nil {
+		t.Error("expected error for invalid config file")
+	}
+
+	cfg := runConfig{jobs: 1, configs: finder, opts: options{Format: formatNone}}
+	if err = run([]string{filepath.Join(root, "svc", "user.pb.go"), filepath.Join(root, "other", "user.pb.go")}, cfg); err != nil {
+		t.Fatal(err)
+	}
+	for dir, db := range map[string]string{"svc": `db:"svc"`, "other": `db:"base"`} {
+		contents, err := os.ReadFile(filepath.Join(root, dir, "user.pb.go"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(string(contents), `json:"email,omitempty" validate:"email"`) || !strings.Contains(string(contents), db) {
+			t.Errorf("%s: config not applied:\n%s", dir, contents)
+		}
+	}
+}
+
+func TestForEach(t *testing.T) {
+	for _, workers := range []int{0, 1, 4, 100} {
+		calls := make([]int, 50)
+		forEach(len(calls), workers, false, func(i int) error {
+			calls[i]++
+			return nil
+		})
+		for i, n := range calls {
+			if n != 1 {
+				t.Errorf("%d workers: expected index %d to be processed once, got: %d", workers, i, n)
+			}
+		}
+	}
+
+	var called int32
+	forEach(50, 1, true, func(i int) error {
+		atomic.AddInt32(&called, 1)
+		return errors.New("failed")
+	})
+	if called != 1 {
+		t.Errorf("expected processing to stop after the first error, got %d calls", called)
+	}
+}
+
+func TestLoggerFlush(t *testing.T) {
+	b := new(bytes.Buffer)
+	log.SetOutput(b)
+	defer log.SetOutput(os.Stderr)
+	verbose = true
+	defer func() { verbose = false }()
+
+	first, second := &logger{}, &logger{}
+	second.logf("second")
+	first.logf("first")
+	if b.Len() > 0 {
+		t.Errorf("logger should hold back its output until flushed")
+	}
+	first.flush()
+	second.flush()
+	if matched, _ := regexp.MatchString("(?s)first.*second", b.String()); !matched {
+		t.Errorf("expected output to be flushed in order, got: %q", b.String())
+	}
+}
+
+func TestHasDirective(t *testing.T) {
+	for _, test := range testsTagFromComment {
+		if test.tag != "" && !hasDirective([]byte(test.comment)) {
+			t.Errorf("expected comment %q to have a directive", test.comment)
+		}
+	}
+	for _, src := range []string{"", "@", "// @go", "// email@example.com", "// @gotag_"} {
+		if hasDirective([]byte(src)) != (src == "// @gotag_") {
+			t.Errorf("unexpected result for %q", src)
+		}
+	}
+	if !hasDirective([]byte("// @GoTags: json:\"a\"")) {
+		t.Errorf("expected directives to be found case insensitively")
+	}
+}
+
+func TestParseFileWithoutDirectives(t *testing.T) {
+	// the prefilter skips parsing, so even invalid Go code yields no error
+	areas, err := parseFile("a.pb.go", []byte("package pb\n\nfunc {"), options{})
+	if err != nil || areas != nil {
+		t.Errorf("expected file without directives to be skipped, got: %v, %v", areas, err)
+	}
+}
+
+// largeFile generates a .pb.go-like file of about size bytes, where every
+// other field has a tag directive.
+func largeFile(size int) []byte {
+	b := bytes.NewBufferString("// Code generated by protoc-gen-go. DO NOT EDIT.\n\npackage pb\n")
+	for i := 0; b.Len() < size; i++ {
+		fmt.Fprintf(b, "\ntype Message%d struct {\n", i)
+		for j := 0; j < 20; j++ {
+			if j%2 == 0 {
+				fmt.Fprintf(b, "\t// @gotags: valid:\"field%d\" yaml:\"field_%d\"\n", j, j)
+			}
+			fmt.Fprintf(b, "\tField%d string `protobuf:\"bytes,%d,opt,name=field%d,proto3\" json:\"field%d,omitempty\"`\n", j, j+1, j, j)
+		}
+		b.WriteString("}\n")
+	}
+	return b.Bytes()
+}
+
+func BenchmarkParseFile(b *testing.B) {
+	contents := largeFile(4 << 20)
+	b.SetBytes(int64(len(contents)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := parseFile("large.pb.go", contents, options{}); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkParseFileWithoutDirectives(b *testing.B) {
+	contents := bytes.ReplaceAll(largeFile(4<<20), []byte("@gotags"), []byte("gotags"))
+	b.SetBytes(int64(len(contents)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := parseFile("large.pb.go", contents, options{}); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkRewriteContents(b *testing.B) {
+	contents := largeFile(4 << 20)
+	areas, err := parseFile("large.pb.go", contents, options{})
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.SetBytes(int64(len(contents)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_ = rewriteContents(contents, areas, options{RemoveTagComment: true})
+	}
+}
+
 func TestVerbose(t *testing.T) {
 	b := new(bytes.Buffer)
 	log.SetOutput(b)
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+)
+
+// manifestEntry is a single file to inject in a -manifest run. Output defaults
+// to Input, and Options default to the ones given on the command line.
+type manifestEntry struct {
+	Input   string          `json:"input"`
+	Output  string          `json:"output,omitempty"`
+	Options json.RawMessage `json:"options,omitempty"`
+
+	opts options
+}
+
+// manifestResult reports the outcome of a manifestEntry.
+type manifestResult struct {
+	Input  string `json:"input"`
+	Output string `json:"output"`
+	Error  string `json:"error,omitempty"`
+}
+
+func readManifest(path string, defaults options) (entries []manifestEntry, err error) {
+	contents, err := os.ReadFile(path)
+	if err != nil {
+		return
+	}
+	if err = json.Unmarshal(contents, &entries); err != nil {
+		return nil, fmt.Errorf("invalid manifest %q: %w", path, err)
+	}
+
+	for i := range entries {
+		entry := &entries[i]
+		if entry.Input == "" {
+			return nil, fmt.Errorf("invalid manifest %q: entry #%d has no input", path, i+1)
+		}
+		if entry.Output == "" {
+			entry.Output = entry.Input
+		}
+
+		if entry.opts, err = entryOptions(defaults, entry.Options); err != nil {
+			return nil, fmt.Errorf("invalid manifest %q: options of entry %q: %w", path, entry.Input, err)
+		}
+	}
+	return
+}
+
+// entryOptions layers the options of a manifest entry over a copy of the
+// defaults. The options it sets replace the defaults, except for its rules,
+// which come after those of the defaults, and its macros, variables and
+// conflict policies, which are merged with those of the defaults.
+func entryOptions(defaults options, raw json.RawMessage) (opts options, err error) {
+	opts = defaults.clone()
+	if len(raw) == 0 {
+		return
+	}
+	opts.Rules = nil
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	dec.DisallowUnknownFields()
+	if err = dec.Decode(&opts); err != nil {
+		return
+	}
+	opts.Rules = append(append([]rule{}, defaults.Rules...), opts.Rules...)
+	return opts, opts.validate()
+}
+
+// clone returns a deep copy of opts, so that decoding into it can't alter the
+// slices and maps of opts.
+func (opts options) clone() options {
+	opts.XXXSkip = append([]string(nil), opts.XXXSkip...)
+	opts.FlagVars = mergeMaps(opts.FlagVars, nil)
+	opts.FlagConflicts = mergeMaps(opts.FlagConflicts, nil)
+	opts.config = config{}.merge(opts.config)
+	return opts
+}
+
+// runManifest processes every entry on up to workers goroutines, even after a
+// failure, and returns one result per entry along with the number of failed
+// entries.
+func runManifest(entries []manifestEntry, workers int) (results []manifestResult, failed int) {
+	results = make([]manifestResult, len(entries))
+	logs := make([]*logger, len(entries))
+	forEach(len(entries), workers, false, func(i int) error {
+		entry := entries[i]
+		opts := entry.opts
+		opts.log = &logger{}
+		logs[i] = opts.log
+
+		results[i] = manifestResult{Input: entry.Input, Output: entry.Output}
+		err := processFile(entry.Input, entry.Output, opts)
+		if err != nil {
+			results[i].Error = err.Error()
+		}
+		return err
+	})
+
+	for i, result := range results {
+		logs[i].flush()
+		if result.Error != "" {
+			failed++
+		}
+	}
+	return
+}
+
+func writeManifestResults(path string, results []manifestResult) error {
+	contents, err := json.MarshalIndent(results, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, append(contents, '\n'), 0o644)
+}
@@ -1,18 +1,90 @@
 package main
 
 import (
+	"bytes"
 	"fmt"
+	"sort"
+	"strconv"
 	"strings"
 )
 
+// hasDirective reports whether src may contain a tag directive. It is much
+// cheaper than parsing src, and lets files without directives be skipped.
+func hasDirective(src []byte) bool {
+	for i := bytes.IndexByte(src, '@'); i >= 0; i = bytes.IndexByte(src, '@') {
+		src = src[i+1:]
+		if hasPrefixFold(src, "gotag") || hasPrefixFold(src, "inject_tag") {
+			return true
+		}
+	}
+	return false
+}
+
+func hasPrefixFold(s []byte, prefix string) bool {
+	return len(s) >= len(prefix) && bytes.EqualFold(s[:len(prefix)], []byte(prefix))
+}
+
 func tagFromComment(comment string) (tag string) {
+	d, _ := parseDirective(comment)
+	return d.tag
+}
+
+// directive is the tag directive of a comment.
+type directive struct {
+	tag string
+	// profiles restrict the directive to the builds selecting one of them.
+	profiles []string
+	// condition guards the directive, if not empty.
+	condition string
+}
+
+// parseDirective returns the directive of comment, whose tag is empty if it
+// has none.
+func parseDirective(comment string) (d directive, err error) {
 	match := rComment.FindStringSubmatch(comment)
-	if len(match) == 2 {
-		tag = match[1]
+	if match == nil {
+		return
+	}
+	use, profiles, guard := match[1] != "", match[2], match[3]
+	if profiles != "" {
+		if !rProfiles.MatchString(profiles) {
+			return d, fmt.Errorf("malformed directive profiles %q", profiles)
+		}
+		for _, profile := range strings.Split(strings.Trim(profiles, "[]"), ",") {
+			d.profiles = append(d.profiles, strings.TrimSpace(profile))
+		}
+	}
+	if guard != "" {
+		match := rGuard.FindStringSubmatch(guard)
+		if match == nil {
+			return directive{}, fmt.Errorf("malformed directive guard %q", guard)
+		}
+		if d.condition, err = strconv.Unquote(match[1]); err != nil {
+			return directive{}, fmt.Errorf("malformed directive guard %q: %w", guard, err)
+		}
+	}
+	d.tag = match[4]
+	// @gotags-use: lists macros instead of tags
+	if use {
+		d.tag = useToTag(d.tag)
 	}
 	return
 }
 
+// inProfile reports whether the directive applies to the builds selecting
+// profile.
+func (d directive) inProfile(profile string) bool {
+	if len(d.profiles) == 0 {
+		return true
+	}
+	for _, p := range d.profiles {
+		if p == profile {
+			return true
+		}
+	}
+	return false
+}
+
 type tagItem struct {
 	key   string
 	value string
@@ -28,6 +100,75 @@ func (ti tagItems) format() string {
 	return strings.Join(tags, " ")
 }
 
+// align formats the items, padding each of them to the width at its index in
+// widths, except the last one.
+func (ti tagItems) align(widths []int) string {
+	if widths == nil {
+		return ti.format()
+	}
+	var b strings.Builder
+	for i, item := range ti {
+		if i > 0 {
+			b.WriteByte(' ')
+		}
+		tag := fmt.Sprintf(`%s:%s`, item.key, item.value)
+		b.WriteString(tag)
+		if i < len(ti)-1 && i < len(widths) {
+			b.WriteString(strings.Repeat(" ", widths[i]-len(tag)))
+		}
+	}
+	return b.String()
+}
+
+// Tag orders are the policies to order the tags of injected fields by. Any
+// other policy is a comma separated list of keys to put first, in that order.
+const (
+	// orderPreserve keeps the existing tags in place and appends new ones. It
+	// is the default.
+	orderPreserve = "preserve"
+	// orderSorted sorts the tags by key.
+	orderSorted = "sorted"
+	// orderProtobufFirst puts the tags of protoc-gen-go first, and sorts the
+	// other ones by key.
+	orderProtobufFirst = "protobuf-first"
+)
+
+// protobufKeys are the tag keys used by protoc-gen-go.
+var protobufKeys = []string{"protobuf", "protobuf_key", "protobuf_val", "protobuf_oneof"}
+
+// order sorts the items according to policy. Keys not listed by an explicit
+// policy come after the listed ones, sorted.
+func (ti tagItems) order(policy string) tagItems {
+	var first []string
+	switch policy {
+	case "", orderPreserve:
+		return ti
+	case orderSorted:
+	case orderProtobufFirst:
+		first = protobufKeys
+	default:
+		first = strings.Split(policy, ",")
+	}
+
+	rank := func(key string) int {
+		for i, k := range first {
+			if strings.TrimSpace(k) == key {
+				return i
+			}
+		}
+		return len(first)
+	}
+	ordered := append(tagItems{}, ti...)
+	sort.SliceStable(ordered, func(i, j int) bool {
+		ri, rj := rank(ordered[i].key), rank(ordered[j].key)
+		if ri != rj {
+			return ri < rj
+		}
+		return ri == len(first) && ordered[i].key < ordered[j].key
+	})
+	return ordered
+}
+
 func (ti tagItems) override(nti tagItems) tagItems {
 	overrided := []tagItem{}
 	for i := range ti {
@@ -62,36 +203,244 @@ func newTagItems(tag string) tagItems {
 	return items
 }
 
-func injectTag(contents []byte, area textArea, removeTagComment bool) (injected []byte) {
-	expr := make([]byte, area.End-area.Start)
-	copy(expr, contents[area.Start-1:area.End-1])
-	cti := newTagItems(area.CurrentTag)
-	iti := newTagItems(area.InjectTag)
-	ti := cti.override(iti)
-	expr = rInject.ReplaceAll(expr, []byte(fmt.Sprintf("`%s`", ti.format())))
-
-	if removeTagComment {
-		strippedComment := make([]byte, area.CommentEnd-area.CommentStart)
-		copy(strippedComment, contents[area.CommentStart-1:area.CommentEnd-1])
-		strippedComment = rAll.ReplaceAll(expr, []byte(" "))
-		if area.CommentStart < area.Start {
-			injected = append(injected, contents[:area.CommentStart-1]...)
-			injected = append(injected, strippedComment...)
-			injected = append(injected, contents[area.CommentEnd-1:area.Start-1]...)
-			injected = append(injected, expr...)
-			injected = append(injected, contents[area.End-1:]...)
-		} else {
-			injected = append(injected, contents[:area.Start-1]...)
-			injected = append(injected, expr...)
-			injected = append(injected, contents[area.End-1:area.CommentStart-1]...)
-			injected = append(injected, strippedComment...)
-			injected = append(injected, contents[area.CommentEnd-1:]...)
+// malformedTag reports whether tag has anything besides key:"value" pairs,
+// which would be silently dropped when injecting it.
+func malformedTag(tag string) bool {
+	return strings.TrimSpace(rTags.ReplaceAllString(tag, "")) != ""
+}
+
+// mergeTags combines the tags injected by several areas of the same field,
+// later areas overriding earlier ones.
+func mergeTags(areas []textArea) string {
+	ti := tagItems{}
+	for _, area := range areas {
+		ti = ti.override(newTagItems(area.InjectTag))
+	}
+	return ti.format()
+}
+
+// edit replaces contents[start:end] with text.
+type edit struct {
+	start int
+	end   int
+	text  []byte
+}
+
+// fieldEdits returns the edit that writes tags to a field, unless it has none
+// and gets none, and, if asked, the edits removing its tag comments. widths pads the tags for -align_tags.
+func fieldEdits(contents []byte, field []textArea, injectTag string, tags tagItems, widths []int, opts options) []edit {
+	area := field[0]
+	expr := contents[area.Start-1 : area.End-1]
+	opts.log.logf("inject custom tag %q to expression %q", injectTag, string(expr))
+
+	var edits []edit
+	tag := fmt.Sprintf("`%s`", tags.align(widths))
+	text := make([]byte, 0, len(expr)+len(tag)+1)
+	if loc := rInject.FindIndex(expr); loc != nil {
+		text = append(append(text, expr[:loc[0]]...), tag...)
+		edits = append(edits, edit{start: area.Start - 1, end: area.End - 1, text: text})
+	} else if len(tags) > 0 {
+		// a field without tags, which only gets one if there is any to inject
+		text = append(append(append(text, expr...), ' '), tag...)
+		edits = append(edits, edit{start: area.Start - 1, end: area.End - 1, text: text})
+	}
+
+	if opts.RemoveTagComment {
+		edits = append(edits, commentEdits(contents, field)...)
+	}
+	return edits
+}
+
+// commentEdits returns the edits that remove the tag comments of a field. If
+// a comment has some text before the directive, only the directive is cut.
+// Otherwise, a trailing comment is removed along with the whitespace before
+// it, and a line of a doc comment is deleted, along with the empty "//" lines
+// this leaves at the start or the end of the doc comment.
+//
+// The text of a line comment doesn't include the '\r' of a CRLF line ending,
+// so the line ending of a trailing comment stays intact.
+func commentEdits(contents []byte, field []textArea) (edits []edit) {
+	directiveLines := map[int]bool{}
+	firstLine := -1
+	for _, area := range field {
+		// areas added for -XXX_skip have no comment to remove
+		if area.CommentStart == 0 {
+			continue
 		}
-	} else {
-		injected = append(injected, contents[:area.Start-1]...)
-		injected = append(injected, expr...)
-		injected = append(injected, contents[area.End-1:]...)
+
+		start, end := area.CommentStart-1, area.CommentEnd-1
+		line := lineStart(contents, start)
+
+		// keep the documentation in front of the directive, if any
+		if loc := rDirective.FindIndex(contents[start:end]); loc != nil {
+			prose := contents[start+len("//") : start+loc[0]]
+			if len(bytes.TrimSpace(prose)) > 0 {
+				start += len("//") + len(bytes.TrimRight(prose, " \t"))
+				edits = append(edits, edit{start: start, end: end})
+				continue
+			}
+		}
+
+		if len(bytes.TrimSpace(contents[line:start])) > 0 {
+			for start > line && (contents[start-1] == ' ' || contents[start-1] == '\t') {
+				start--
+			}
+			edits = append(edits, edit{start: start, end: end})
+			continue
+		}
+
+		directiveLines[line] = true
+		if firstLine == -1 {
+			firstLine = line
+		}
+	}
+	if firstLine == -1 {
+		return
 	}
 
+	// find the whole doc comment around the directive lines, and keep what
+	// is left of it without surrounding empty lines
+	groupStart := firstLine
+	for groupStart > 0 {
+		prev := lineStart(contents, groupStart-1)
+		if !isLineComment(contents[prev:groupStart]) {
+			break
+		}
+		groupStart = prev
+	}
+	var lines, kept []int
+	for line := groupStart; line < len(contents) && isLineComment(contents[line:lineEnd(contents, line)]); line = lineEnd(contents, line) {
+		lines = append(lines, line)
+		if !directiveLines[line] {
+			kept = append(kept, line)
+		}
+	}
+	isEmpty := func(line int) bool {
+		return string(bytes.TrimSpace(contents[line:lineEnd(contents, line)])) == "//"
+	}
+	for len(kept) > 0 && isEmpty(kept[0]) {
+		kept = kept[1:]
+	}
+	for len(kept) > 0 && isEmpty(kept[len(kept)-1]) {
+		kept = kept[:len(kept)-1]
+	}
+
+	for _, line := range lines {
+		if len(kept) > 0 && line >= kept[0] && line <= kept[len(kept)-1] && !directiveLines[line] {
+			continue
+		}
+		edits = append(edits, edit{start: line, end: lineEnd(contents, line)})
+	}
 	return
 }
+
+// lineStart returns the offset of the start of the line containing offset i.
+func lineStart(contents []byte, i int) int {
+	return bytes.LastIndexByte(contents[:i], '\n') + 1
+}
+
+// lineEnd returns the offset just past the line ending of the line starting at
+// offset i.
+func lineEnd(contents []byte, i int) int {
+	if j := bytes.IndexByte(contents[i:], '\n'); j >= 0 {
+		return i + j + 1
+	}
+	return len(contents)
+}
+
+func isLineComment(line []byte) bool {
+	return bytes.HasPrefix(bytes.TrimSpace(line), []byte("//"))
+}
+
+// rewriteContents injects all areas into contents in a single pass. All the
+// directives of a field are merged and injected at once, later ones taking
+// precedence.
+func rewriteContents(contents []byte, areas []textArea, opts options) []byte {
+	if len(areas) == 0 {
+		return contents
+	}
+
+	var fields [][]textArea
+	for start := 0; start < len(areas); {
+		end := start + 1
+		for end < len(areas) && areas[end].Start == areas[start].Start {
+			end++
+		}
+		fields = append(fields, areas[start:end])
+		start = end
+	}
+
+	injectTags := make([]string, len(fields))
+	tags := make([]tagItems, len(fields))
+	for i, field := range fields {
+		injectTags[i] = mergeTags(field)
+		tags[i] = newTagItems(field[0].CurrentTag).resolve(newTagItems(injectTags[i]), opts.conflictPolicy).order(opts.TagOrder)
+	}
+	var widths [][]int
+	if opts.AlignTags {
+		widths = alignTags(contents, fields, tags)
+	}
+
+	var edits []edit
+	for i, field := range fields {
+		var fieldWidths []int
+		if widths != nil {
+			fieldWidths = widths[i]
+		}
+		edits = append(edits, fieldEdits(contents, field, injectTags[i], tags[i], fieldWidths, opts)...)
+	}
+	return applyEdits(contents, edits)
+}
+
+// alignTags returns, for each field, the width to pad each of its tags to, so
+// that the tags of consecutive lines of a struct start in the same columns.
+func alignTags(contents []byte, fields [][]textArea, tags []tagItems) [][]int {
+	widths := make([][]int, len(fields))
+	for start := 0; start < len(fields); {
+		// a block of fields of the same struct on consecutive lines
+		end := start + 1
+		for end < len(fields) && fields[end][0].Decl == fields[start][0].Decl &&
+			bytes.Count(contents[fields[end-1][0].Start-1:fields[end][0].Start-1], []byte("\n")) == 1 {
+			end++
+		}
+
+		var blockWidths []int
+		for _, ti := range tags[start:end] {
+			for i, item := range ti {
+				if i == len(blockWidths) {
+					blockWidths = append(blockWidths, 0)
+				}
+				if n := len(item.key) + 1 + len(item.value); n > blockWidths[i] {
+					blockWidths[i] = n
+				}
+			}
+		}
+		for i := start; i < end; i++ {
+			widths[i] = blockWidths
+		}
+		start = end
+	}
+	return widths
+}
+
+// applyEdits applies non-overlapping edits to contents.
+func applyEdits(contents []byte, edits []edit) []byte {
+	sort.Slice(edits, func(i, j int) bool { return edits[i].start < edits[j].start })
+
+	size := len(contents)
+	for _, e := range edits {
+		size += len(e.text) - (e.end - e.start)
+	}
+	rewritten := make([]byte, 0, size)
+	last := 0
+	for _, e := range edits {
+		rewritten = append(rewritten, contents[last:e.start]...)
+		rewritten = append(rewritten, e.text...)
+		last = e.end
+	}
+	return append(rewritten, contents[last:]...)
+}
+
+func injectTag(contents []byte, area textArea, removeTagComment bool) (injected []byte) {
+	return rewriteContents(contents, []textArea{area}, options{RemoveTagComment: removeTagComment})
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// forEach calls fn for every index in [0, n) on up to workers goroutines, and
+// waits for all of them to return. With stopOnError set, no further calls are
+// started once one of them has failed. Each call may only touch the state of
+// its own index.
+func forEach(n, workers int, stopOnError bool, fn func(i int) error) {
+	if workers < 1 {
+		workers = 1
+	}
+	if workers > n {
+		workers = n
+	}
+
+	var (
+		wg     sync.WaitGroup
+		next   int64 = -1
+		failed int32
+	)
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				i := int(atomic.AddInt64(&next, 1))
+				if i >= n || (stopOnError && atomic.LoadInt32(&failed) != 0) {
+					return
+				}
+				if err := fn(i); err != nil {
+					atomic.StoreInt32(&failed, 1)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// protoTag is the metadata protoc-gen-go encodes in the struct tags of a
+// field, e.g. `protobuf:"bytes,1,opt,name=address,json=address,proto3"`.
+type protoTag struct {
+	// Wire is the wire type: varint, zigzag32, zigzag64, fixed32, fixed64,
+	// bytes or group.
+	Wire   string
+	Number int
+	// Cardinality is optional, repeated or required. protoc-gen-go writes
+	// optional for every singular field, including those of proto3 files
+	// that aren't declared optional.
+	Cardinality string
+	Name        string
+	JSONName    string
+	// Enum is the proto full name of the enum type of the field, if any.
+	Enum   string
+	Proto3 bool
+	Packed bool
+	// Oneof is true for the members of a oneof, and for the field holding
+	// it, whose Name is the name of the oneof. It is true for proto3 optional
+	// fields too, which are members of a synthetic oneof.
+	Oneof bool
+	// Map is true for map fields.
+	Map bool
+}
+
+// cardinalities maps the cardinalities of protobuf tags to their names.
+var cardinalities = map[string]string{"opt": "optional", "rep": "repeated", "req": "required"}
+
+// parseProtoTag parses the protobuf metadata in the struct tag of a field. ok
+// is false if the field isn't a protobuf field.
+func parseProtoTag(tag string) (pt protoTag, ok bool) {
+	st := reflect.StructTag(tag)
+	if oneof, found := st.Lookup("protobuf_oneof"); found {
+		return protoTag{Name: oneof, Oneof: true}, true
+	}
+	value, found := st.Lookup("protobuf")
+	if !found {
+		return
+	}
+
+	parts := strings.Split(value, ",")
+	for i, part := range parts {
+		switch {
+		case i == 0:
+			pt.Wire = part
+		case i == 1:
+			pt.Number, _ = strconv.Atoi(part)
+		case i == 2:
+			pt.Cardinality = cardinalities[part]
+		case strings.HasPrefix(part, "name="):
+			pt.Name = strings.TrimPrefix(part, "name=")
+		case strings.HasPrefix(part, "json="):
+			pt.JSONName = strings.TrimPrefix(part, "json=")
+		case strings.HasPrefix(part, "enum="):
+			pt.Enum = strings.TrimPrefix(part, "enum=")
+		case part == "proto3":
+			pt.Proto3 = true
+		case part == "packed":
+			pt.Packed = true
+		case part == "oneof":
+			pt.Oneof = true
+		}
+	}
+	// the JSON name is only written when it differs from the name
+	if pt.JSONName == "" {
+		pt.JSONName = pt.Name
+	}
+	_, pt.Map = st.Lookup("protobuf_key")
+	return pt, true
+}
+
+// protoSelector matches the protobuf metadata of a field. Wire, Cardinality,
+// Name, JSONName and Enum are regular expressions matching whole values, and
+// Enum only matches enum fields.
+type protoSelector struct {
+	Wire        string `json:"wire,omitempty" yaml:"wire,omitempty"`
+	Cardinality string `json:"cardinality,omitempty" yaml:"cardinality,omitempty"`
+	Name        string `json:"name,omitempty" yaml:"name,omitempty"`
+	JSONName    string `json:"json_name,omitempty" yaml:"json_name,omitempty"`
+	Enum        string `json:"enum,omitempty" yaml:"enum,omitempty"`
+	Number      int    `json:"number,omitempty" yaml:"number,omitempty"`
+	Oneof       *bool  `json:"oneof,omitempty" yaml:"oneof,omitempty"`
+	Map         *bool  `json:"map,omitempty" yaml:"map,omitempty"`
+}
+
+// patterns returns the regular expressions of s.
+func (s protoSelector) patterns() []string {
+	return []string{s.Wire, s.Cardinality, s.Name, s.JSONName, s.Enum}
+}
+
+func (s protoSelector) matches(field fieldInfo) bool {
+	pt := field.protobuf()
+	switch {
+	case s.Enum != "" && pt.Enum == "",
+		s.Number != 0 && s.Number != pt.Number,
+		s.Oneof != nil && *s.Oneof != field.oneof(),
+		s.Map != nil && *s.Map != pt.Map:
+		return false
+	}
+	return matchRegexp(s.Wire, pt.Wire) && matchRegexp(s.Cardinality, pt.Cardinality) &&
+		matchRegexp(s.Name, pt.Name) && matchRegexp(s.JSONName, pt.JSONName) && matchRegexp(s.Enum, pt.Enum)
+}
+
+// protoType returns the proto type of a field from its protobuf metadata and
+// its Go type expression, e.g. "string" for a repeated string field.
+func protoType(pt protoTag, goType string) string {
+	if pt.Map {
+		return "map"
+	}
+	if pt.Cardinality == "repeated" {
+		goType = strings.TrimPrefix(goType, "[]")
+	}
+	goType = strings.TrimPrefix(goType, "*")
+
+	switch pt.Wire {
+	case "bytes":
+		switch goType {
+		case "string":
+			return "string"
+		case "[]byte":
+			return "bytes"
+		}
+		return "message"
+	case "varint":
+		if pt.Enum != "" {
+			return "enum"
+		}
+		switch goType {
+		case "bool", "int32", "int64", "uint32", "uint64":
+			return goType
+		}
+		return "enum"
+	case "zigzag32":
+		return "sint32"
+	case "zigzag64":
+		return "sint64"
+	case "fixed32":
+		return map[string]string{"uint32": "fixed32", "int32": "sfixed32", "float32": "float"}[goType]
+	case "fixed64":
+		return map[string]string{"uint64": "fixed64", "int64": "sfixed64", "float64": "double"}[goType]
+	}
+	return pt.Wire
+}
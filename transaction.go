@@ -0,0 +1,135 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"go/parser"
+	"go/token"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+// journalEntry records the state of an output file before a transaction
+// replaced it, so that it can be restored.
+type journalEntry struct {
+	path     string
+	existed  bool
+	contents []byte
+	src      fs.FileInfo
+}
+
+// commitAll writes every changed rewrite, or none of them. The rewrites are
+// validated and staged to temporary files first, and only then the outputs
+// are replaced one by one. Their previous state is kept in a journal that is
+// replayed if a replacement fails.
+func commitAll(rewrites []rewrite) (err error) {
+	if err = validateRewrites(rewrites); err != nil {
+		return
+	}
+
+	staged := make([]string, len(rewrites))
+	defer func() {
+		for _, tmp := range staged {
+			if tmp != "" {
+				os.Remove(tmp)
+			}
+		}
+	}()
+	for i, rw := range rewrites {
+		if !rw.changed {
+			continue
+		}
+		if err = os.MkdirAll(filepath.Dir(rw.output), 0o755); err != nil {
+			return
+		}
+		if staged[i], err = stageFile(rw.output, rw.contents, rw.src); err != nil {
+			return
+		}
+	}
+
+	var journal []journalEntry
+	for i, rw := range rewrites {
+		if !rw.changed {
+			continue
+		}
+
+		var entry journalEntry
+		if entry, err = journalFile(rw.output); err == nil {
+			err = os.Rename(staged[i], rw.output)
+		}
+		if err != nil {
+			if rbErr := rollback(journal); rbErr != nil {
+				return fmt.Errorf("%w (rollback failed: %v)", err, rbErr)
+			}
+			return fmt.Errorf("%w (all files rolled back)", err)
+		}
+		staged[i] = ""
+		journal = append(journal, entry)
+		logf("file %q is injected with custom tags", rw.output)
+	}
+	return
+}
+
+// validateRewrites checks that every rewrite is still valid Go and that no two
+// rewrites target the same output.
+func validateRewrites(rewrites []rewrite) error {
+	fset := token.NewFileSet()
+	outputs := make(map[string]string, len(rewrites))
+	for _, rw := range rewrites {
+		output, err := filepath.Abs(rw.output)
+		if err != nil {
+			return err
+		}
+		if input, ok := outputs[output]; ok {
+			return fmt.Errorf("input files %q and %q are both written to %q", input, rw.input, rw.output)
+		}
+		outputs[output] = rw.input
+
+		if !rw.changed {
+			continue
+		}
+		if _, err = parser.ParseFile(fset, rw.output, rw.contents, parser.ParseComments); err != nil {
+			return fmt.Errorf("injecting %q results in invalid Go code: %w", rw.input, err)
+		}
+	}
+	return nil
+}
+
+func journalFile(path string) (entry journalEntry, err error) {
+	entry.path = path
+	entry.src, err = os.Stat(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return entry, nil
+	}
+	if err != nil {
+		return
+	}
+	entry.existed = true
+	entry.contents, err = os.ReadFile(path)
+	return
+}
+
+// rollback restores the journaled files in reverse order. It carries on after
+// a failure and returns the first error.
+func rollback(journal []journalEntry) (err error) {
+	for i := len(journal) - 1; i >= 0; i-- {
+		entry := journal[i]
+		var rbErr error
+		if entry.existed {
+			rbErr = writeFileAtomic(entry.path, entry.contents, entry.src)
+		} else {
+			rbErr = os.Remove(entry.path)
+		}
+		if rbErr != nil {
+			log.Printf("can't roll back %q: %v", entry.path, rbErr)
+			if err == nil {
+				err = rbErr
+			}
+			continue
+		}
+		logf("file %q is rolled back", entry.path)
+	}
+	return
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// rVar matches the variable references of a tag, e.g. ${uuid_type}.
+var rVar = regexp.MustCompile(`\$\{([^}]*)\}`)
+
+var rVarName = regexp.MustCompile(`^[\w.-]+$`)
+
+// expandTags expands the macros of tag, and then its variables.
+func (opts options) expandTags(tag string) (string, error) {
+	tag, err := opts.expandMacros(tag)
+	if err != nil {
+		return "", err
+	}
+	return opts.expandVars(tag)
+}
+
+// expandVars replaces the variable references of tag with the values of the
+// variables, those given with -var taking precedence over those of the config.
+func (opts options) expandVars(tag string) (string, error) {
+	if !strings.Contains(tag, "${") {
+		return tag, nil
+	}
+
+	var err error
+	expanded := rVar.ReplaceAllStringFunc(tag, func(ref string) string {
+		name := ref[2 : len(ref)-1]
+		if value, ok := opts.FlagVars[name]; ok {
+			return value
+		}
+		if value, ok := opts.Vars[name]; ok {
+			return value
+		}
+		if err == nil {
+			err = fmt.Errorf("undefined variable %q", name)
+		}
+		return ref
+	})
+	return expanded, err
+}
+
+// validateVars checks the names of the variables.
+func validateVars(vars map[string]string) error {
+	for name := range vars {
+		if !rVarName.MatchString(name) {
+			return fmt.Errorf("invalid variable name %q", name)
+		}
+	}
+	return nil
+}
+
+// varsFlag is a repeatable key=value flag.
+type varsFlag map[string]string
+
+func (v varsFlag) String() string {
+	var vars []string
+	for name, value := range v {
+		vars = append(vars, name+"="+value)
+	}
+	sort.Strings(vars)
+	return strings.Join(vars, ",")
+}
+
+func (v varsFlag) Set(s string) error {
+	name, value, ok := strings.Cut(s, "=")
+	if !ok || !rVarName.MatchString(name) {
+		return fmt.Errorf("%q isn't a name=value variable", s)
+	}
+	v[name] = value
+	return nil
+}
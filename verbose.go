@@ -1,6 +1,7 @@
 package main
 
 import (
+	"fmt"
 	"log"
 )
 
@@ -12,3 +13,40 @@ func logf(format string, v ...interface{}) {
 	}
 	log.Printf(format, v...)
 }
+
+// logger holds back the verbose output of a single file until flush is called,
+// so that files processed concurrently are logged in a deterministic order. A
+// nil logger logs right away.
+type logger struct {
+	lines []string
+}
+
+func (l *logger) logf(format string, v ...interface{}) {
+	if l == nil {
+		logf(format, v...)
+		return
+	}
+	if !verbose {
+		return
+	}
+	l.lines = append(l.lines, fmt.Sprintf(format, v...))
+}
+
+// warnf is like logf, but its output is kept even without -verbose.
+func (l *logger) warnf(format string, v ...interface{}) {
+	if l == nil {
+		log.Printf(format, v...)
+		return
+	}
+	l.lines = append(l.lines, fmt.Sprintf(format, v...))
+}
+
+func (l *logger) flush() {
+	if l == nil {
+		return
+	}
+	for _, line := range l.lines {
+		log.Print(line)
+	}
+	l.lines = nil
+}
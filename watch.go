@@ -0,0 +1,111 @@
+package main
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// watchDebounce is how long to wait for more changes before re-running, as
+// protoc usually writes a batch of files.
+const watchDebounce = 250 * time.Millisecond
+
+// watch injects the files matching pattern, then keeps re-injecting them
+// whenever they are created or written, until stop is closed. Only the
+// directories that exist when watching starts are watched.
+func watch(pattern string, cfg runConfig, stop <-chan struct{}) error {
+	pattern = filepath.Clean(pattern)
+
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	defer w.Close()
+
+	dirs, err := filepath.Glob(filepath.Dir(pattern))
+	if err != nil {
+		return err
+	}
+	for _, dir := range dirs {
+		if finfo, err := os.Stat(dir); err != nil || !finfo.IsDir() {
+			continue
+		}
+		if err = w.Add(dir); err != nil {
+			return err
+		}
+		logf("watching directory %q", dir)
+	}
+
+	// the hashes of the files as the last run left them, so that the events
+	// caused by writing them don't trigger another run
+	seen := map[string]string{}
+	runMatching := func(changed map[string]bool) {
+		paths, err := matchFiles(pattern)
+		if err != nil {
+			log.Print(err)
+			return
+		}
+
+		var stale []string
+		for _, path := range paths {
+			if changed != nil && !changed[path] {
+				continue
+			}
+			if hash, err := hashFile(path); err == nil && hash == seen[path] {
+				continue
+			}
+			stale = append(stale, path)
+		}
+		if len(stale) == 0 {
+			return
+		}
+
+		// pick up the changes to config files since the last run
+		if cfg.configs != nil {
+			cfg.configs = newConfigFinder()
+		}
+		if err = run(stale, cfg); err != nil {
+			log.Print(err)
+		}
+		for _, path := range stale {
+			if hash, err := hashFile(path); err == nil {
+				seen[path] = hash
+			}
+		}
+	}
+
+	runMatching(nil)
+
+	changed := map[string]bool{}
+	debounce := time.NewTimer(watchDebounce)
+	debounce.Stop()
+	for {
+		select {
+		case event, ok := <-w.Events:
+			if !ok {
+				return nil
+			}
+			if !event.Has(fsnotify.Create) && !event.Has(fsnotify.Write) {
+				continue
+			}
+			if matched, _ := filepath.Match(pattern, event.Name); !matched {
+				continue
+			}
+			changed[event.Name] = true
+			debounce.Reset(watchDebounce)
+		case err, ok := <-w.Errors:
+			if !ok {
+				return nil
+			}
+			log.Print(err)
+		case <-debounce.C:
+			runMatching(changed)
+			changed = map[string]bool{}
+		case <-stop:
+			return nil
+		}
+	}
+}